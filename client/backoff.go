@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backoff of the reconnection when the requests to the server keep failing
+type Backoff struct {
+	// Min is the delay of the first retry, it's multiplied by the Factor for each failure until it reaches the Max.
+	// The DefaultBackoff is used for the Min and Factor if they are invalid, and for the Max if it's not positive.
+	Min    time.Duration
+	Max    time.Duration
+	Factor float64
+
+	// Jitter is the random portion of the delay, from 0 to 1, so that the clients won't retry at the same time
+	Jitter float64
+
+	// MaxRetries is the number of the consecutive failures to give up after, 0 means never give up
+	MaxRetries int
+}
+
+// DefaultBackoff ...
+var DefaultBackoff = Backoff{
+	Min:    500 * time.Millisecond,
+	Max:    30 * time.Second,
+	Factor: 2,
+	Jitter: 0.2,
+}
+
+// delay before the nth retry
+func (b Backoff) delay(n int) time.Duration {
+	if b.Min <= 0 || b.Factor < 1 {
+		b.Min, b.Max, b.Factor = DefaultBackoff.Min, DefaultBackoff.Max, DefaultBackoff.Factor
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoff.Max
+	}
+
+	d := math.Min(float64(b.Min)*math.Pow(b.Factor, float64(n-1)), float64(b.Max))
+	d -= d * math.Min(math.Max(b.Jitter, 0), 1) * rand.Float64()
+	return time.Duration(d)
+}
+
+// State of the connection to the server
+type State int
+
+const (
+	// StateConnected the server responds again after it was disconnected, or for the first time
+	StateConnected State = iota
+	// StateDisconnected a request to the server fails after it was connected
+	StateDisconnected
+	// StateReconnecting waits for the backoff delay before the next retry
+	StateReconnecting
+)
+
+var stateNames = []string{"connected", "disconnected", "reconnecting"}
+
+// String ...
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// idlePoll is how long a poll can be held before the server closes it as idle,
+// a poll that is connected and fails after that is not counted as a failure
+const idlePoll = 10 * time.Second
+
+// traceConn returns the ctx for a request to the server, the connected returns true after the connection is made
+func traceConn(ctx context.Context) (traced context.Context, connected func() bool) {
+	var n int32
+	traced = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { atomic.StoreInt32(&n, 1) },
+	})
+	return traced, func() bool { return atomic.LoadInt32(&n) == 1 }
+}
+
+// link is the connection to the server shared by the loops, it reports the state when it changes
+type link struct {
+	c     *Client
+	lock  sync.Mutex
+	state *State
+}
+
+func (c *Client) link() *link {
+	return &link{c: c}
+}
+
+func (l *link) set(s State, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.state != nil && *l.state == s {
+		return
+	}
+	l.state = &s
+	l.c.state(s, err)
+}
+
+// report the event without changing the state, such as StateReconnecting
+func (l *link) report(s State, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.c.state(s, err)
+}
+
+// retry tracks the consecutive failures of a loop
+type retry struct {
+	c         *Client
+	link      *link
+	failures  int
+	start     time.Time
+	connected func() bool
+}
+
+func (l *link) retry() *retry {
+	return &retry{c: l.c, link: l}
+}
+
+// attempt is called before each request to the server, use the returned ctx for the request
+func (r *retry) attempt(ctx context.Context) context.Context {
+	ctx, r.connected = traceConn(ctx)
+	r.start = time.Now()
+	return ctx
+}
+
+// ok is called when a request succeeds
+func (r *retry) ok() {
+	r.failures = 0
+	r.link.set(StateConnected, nil)
+}
+
+// fail waits with the backoff, it returns error if it should give up or the ctx is done.
+// The dial and transport errors are failures, such as a dial that times out after the idlePoll.
+// It gives up at once on ErrUnauthorized, retrying with the same credentials won't help.
+func (r *retry) fail(ctx context.Context, err error) error {
+	if errors.Is(err, ErrUnauthorized) {
+		r.link.set(StateDisconnected, err)
+		return err
+	}
+
+	if r.connected != nil && r.connected() && time.Since(r.start) > idlePoll {
+		return nil
+	}
+
+	r.failures++
+	if r.failures == 1 {
+		r.link.set(StateDisconnected, err)
+	}
+
+	if r.c.Backoff.MaxRetries > 0 && r.failures > r.c.Backoff.MaxRetries {
+		return fmt.Errorf("give up after %d retries: %w", r.c.Backoff.MaxRetries, err)
+	}
+
+	r.link.report(StateReconnecting, err)
+
+	select {
+	case <-time.After(r.c.Backoff.delay(r.failures)):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (c *Client) state(s State, err error) {
+	if c.OnState != nil {
+		c.OnState(s, err)
+	}
+}
@@ -1,13 +1,17 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
+	"github.com/ysmood/digto/internal/netutil"
 	"github.com/ysmood/kit"
 )
 
@@ -19,6 +23,12 @@ type Client struct {
 	// Subdomain ...
 	Subdomain string
 
+	// Token to consume the subdomain if it's reserved, check Reserve
+	Token string
+
+	// Key the api key, required if the server enables the authentication
+	Key string
+
 	// APIScheme to use for api request
 	APIScheme string
 	// APIHost api host
@@ -26,14 +36,48 @@ type Client struct {
 	// Host api header host
 	APIHeaderHost string
 
-	httpClient *http.Client
+	// Multiplex makes Serve receive requests over a single long-lived connection,
+	// polling is still used for protocol switching requests and as the fallback
+	Multiplex bool
+
+	// Pollers is the number of the parallel long polls of Serve, more pollers reduce the pickup latency under load.
+	// Default is 1.
+	Pollers int
+
+	// MaxInFlight caps the requests Serve forwards to the tcp address at the same time, 0 means no limit.
+	// When it's reached Serve stops taking new requests, they wait on the server until a slot is free.
+	MaxInFlight int
+
+	// Backoff of Serve and ServeTCP when the server is unreachable
+	Backoff Backoff
+
+	// OnState is called when the state of the connection to the server changes, the err is the cause of the failure
+	OnState func(state State, err error)
+
+	httpClient    *http.Client
+	upgradeClient *http.Client
 
 	Log func(...interface{})
 }
 
-// Send response back to the public request
+// Send response back to the public request.
+// If the status is 101 the body must be an io.ReadWriter, such as a net.Conn,
+// Send will splice it with the public connection and return when either side closes.
 type Send func(status int, header http.Header, body io.Reader) error
 
+// ErrNotStream is returned when the body of a 101 response is not an io.ReadWriter
+var ErrNotStream = errors.New("body of the switching protocols response must be an io.ReadWriter")
+
+// ErrUpgrade is returned when the server refuses to switch protocols
+var ErrUpgrade = errors.New("server failed to switch protocols")
+
+// ErrUnauthorized is returned when the server responds 401 or 403, such as the Digto-Key or the Digto-Token
+// is invalid, the retries give up on it
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrMuxClosed is returned when the server closes the multiplexed connection
+var ErrMuxClosed = errors.New("the mux connection is closed by the server")
+
 // New creates a client with default config
 func New(subdomain string) *Client {
 	return &Client{
@@ -42,8 +86,14 @@ func New(subdomain string) *Client {
 		APIHost:       "digto.org",
 		APIHeaderHost: "digto.org",
 		Subdomain:     subdomain,
+		Backoff:       DefaultBackoff,
 		httpClient:    &http.Client{},
 		Log:           func(s ...interface{}) {},
+		upgradeClient: &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			// protocol switching is only possible with http/1.1
+			TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+		}},
 	}
 }
 
@@ -52,21 +102,109 @@ func (c *Client) PublicURL() string {
 	return c.Scheme + "://" + c.Subdomain + "." + c.APIHost
 }
 
-// Next gets the next request from public
-func (c *Client) Next() (*http.Request, Send, error) {
-	apiURL := url.URL{
+// Reserve claims the subdomain so that only the clients with the token can consume it.
+// The token will be set to the Token field.
+func (c *Client) Reserve() (string, error) {
+	res, err := resError(c.req("reserve").Post().Response())
+	if err != nil {
+		return "", err
+	}
+	_ = res.Body.Close()
+
+	c.Token = res.Header.Get("Digto-Token")
+	return c.Token, nil
+}
+
+// Release the reservation of the subdomain
+func (c *Client) Release() error {
+	res, err := resError(c.req("reserve").Delete().Response())
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// EnableQueue turns on the durable mode of the subdomain, the public requests will be responded with the status
+// right away and stored until a client takes them via Next, so that they won't be lost while no client is online.
+func (c *Client) EnableQueue(status int) error {
+	res, err := resError(c.req("queue").Put().Query("status", strconv.Itoa(status)).Response())
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// DisableQueue turns off the durable mode of the subdomain, the stored requests will still be delivered
+func (c *Client) DisableQueue() error {
+	res, err := resError(c.req("queue").Delete().Response())
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// AddDomain routes the custom domain to the subdomain, the subdomain must be reserved and
+// the CNAME of the domain must point to the subdomain. The certificate of the domain is obtained on the first https request.
+func (c *Client) AddDomain(name string) error {
+	res, err := resError(c.req("domain").Post().Query("name", name).Response())
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// RemoveDomain stops routing the custom domain to the subdomain
+func (c *Client) RemoveDomain(name string) error {
+	res, err := resError(c.req("domain").Delete().Query("name", name).Response())
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Replay re-delivers a captured public request of the subdomain to the current client,
+// the id is the Digto-ID of the request. It returns the response of the replayed request.
+func (c *Client) Replay(id string) (*http.Response, error) {
+	return resError(c.req("replay/" + id).Post().Response())
+}
+
+// req creates a request to the api with the auth headers
+func (c *Client) req(action string) *kit.ReqContext {
+	return kit.Req(c.apiURL(action)).Client(c.httpClient).Host(c.APIHeaderHost).Header(c.authHeader()...)
+}
+
+func (c *Client) authHeader() []string {
+	return []string{"Digto-Token", c.Token, "Digto-Key", c.Key}
+}
+
+// apiURL returns the url of "/{subdomain}/{action}" on the api host
+func (c *Client) apiURL(action string) string {
+	u := url.URL{
 		Scheme: c.APIScheme,
 		Host:   c.APIHost,
 		Path:   c.Subdomain,
 	}
+	if action != "" {
+		u.Path += "/" + action
+	}
+	return u.String()
+}
 
-	senderRes, err := resError(kit.Req(apiURL.String()).Client(c.httpClient).Host(c.APIHeaderHost).Response())
+// Next gets the next request from public
+func (c *Client) Next() (*http.Request, Send, error) {
+	return c.NextContext(context.Background())
+}
+
+// NextContext is the same as Next, the polling is canceled when the ctx is done.
+// The ctx is also the context of the returned request, the send isn't affected by it.
+func (c *Client) NextContext(ctx context.Context) (*http.Request, Send, error) {
+	senderRes, err := resError(c.req("").Context(ctx).Response())
 	if err != nil {
 		return nil, nil, err
 	}
 
 	receiverReq, err := http.NewRequestWithContext(
-		senderRes.Request.Context(),
+		ctx,
 		senderRes.Header.Get("Digto-Method"),
 		c.PublicURL()+senderRes.Header.Get("Digto-URL"),
 		senderRes.Body,
@@ -76,7 +214,8 @@ func (c *Client) Next() (*http.Request, Send, error) {
 	}
 
 	for k, v := range senderRes.Header {
-		if !strings.HasPrefix(k, "Digto") {
+		// the Digto-Replay header marks the request replayed from the inspector
+		if !strings.HasPrefix(k, "Digto") || k == "Digto-Replay" {
 			receiverReq.Header[k] = v
 		}
 	}
@@ -96,24 +235,79 @@ func (c *Client) Next() (*http.Request, Send, error) {
 			}
 		}
 
-		_, err = resError(
-			kit.Req(apiURL.String()).Post().
-				Client(c.httpClient).
-				Host(c.APIHeaderHost).
-				Header(headerToSend...).Body(body).Response(),
-		)
+		if status == http.StatusSwitchingProtocols {
+			return c.tunnel(headerToSend, body)
+		}
+
+		_, err = resError(c.req("").Post().Header(headerToSend...).Body(body).Response())
 		return err
 	}
 
 	return receiverReq, send, nil
 }
 
+// tunnel upgrades the api connection and splices it with the stream
+func (c *Client) tunnel(header []string, stream io.Reader) error {
+	rw, ok := stream.(io.ReadWriter)
+	if !ok {
+		return ErrNotStream
+	}
+
+	conn, err := c.upgrade(context.Background(), http.MethodPost, "", header...)
+	if err != nil {
+		return err
+	}
+
+	netutil.Splice(conn, rw)
+	return nil
+}
+
+// upgrade sends a request to the api host and takes over the connection after the server switches protocols
+func (c *Client) upgrade(ctx context.Context, method, action string, header ...string) (io.ReadWriteCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL(action), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Host = c.APIHeaderHost
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Add(header[i], header[i+1])
+	}
+	auth := c.authHeader()
+	for i := 0; i < len(auth); i += 2 {
+		req.Header.Set(auth[i], auth[i+1])
+	}
+	req.Header.Set("Connection", "Upgrade")
+	if req.Header.Get("Upgrade") == "" {
+		req.Header.Set("Upgrade", "digto")
+	}
+
+	res, err := resError(c.upgradeClient.Do(req))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, ok := res.Body.(io.ReadWriteCloser)
+	if res.StatusCode != http.StatusSwitchingProtocols || !ok {
+		_ = res.Body.Close()
+		return nil, ErrUpgrade
+	}
+
+	return conn, nil
+}
+
 func resError(res *http.Response, err error) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
 
 	errMsg := res.Header.Get("Digto-Error")
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		if errMsg == "" {
+			errMsg = res.Status
+		}
+		return res, fmt.Errorf("%w: %s", ErrUnauthorized, errMsg)
+	}
 	if errMsg != "" {
 		return res, errors.New(errMsg)
 	}
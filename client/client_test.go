@@ -1,9 +1,17 @@
 package client_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -122,3 +130,589 @@ func TestServe(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestServeContext(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := s.GetServer().Listener.Addr().String()
+	subdomain := kit.RandString(16)
+
+	c := client.New(subdomain)
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+
+	started := make(chan kit.Nil)
+	srv := kit.MustServer("127.0.0.1:0")
+	srv.Engine.GET("/slow", func(ctx kit.GinContext) {
+		started <- kit.Nil{}
+		<-ctx.Request.Context().Done()
+	})
+	go srv.MustDo()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- c.ServeContext(ctx, srv.Listener.Addr().String(), "", "") }()
+
+	status := make(chan int)
+	go func() {
+		status <- kit.Req("http://" + host + "/slow").Host(subdomain + ".digto.org").MustResponse().StatusCode
+	}()
+
+	// the in-flight request is responded before ServeContext returns
+	<-started
+	cancel()
+	assert.Equal(t, context.Canceled, <-served)
+	assert.Equal(t, http.StatusInternalServerError, <-status)
+
+	_, _, err = c.NextContext(ctx)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	kit.E(err)
+	host := l.Addr().String()
+	kit.E(l.Close())
+
+	c := client.New(kit.RandString(16))
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.Backoff = client.Backoff{Min: 10 * time.Millisecond, Max: 20 * time.Millisecond, Factor: 2, MaxRetries: 2}
+
+	states := []string{}
+	c.OnState = func(state client.State, _ error) {
+		states = append(states, state.String())
+	}
+
+	start := time.Now()
+	err = c.ServeContext(context.Background(), "127.0.0.1:1", "", "")
+	assert.Regexp(t, `^give up after 2 retries: .+ connection refused`, err.Error())
+	assert.Equal(t, []string{"disconnected", "reconnecting", "reconnecting"}, states)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	// the default max is used if it's not set
+	c.Backoff = client.Backoff{Min: 20 * time.Millisecond, Factor: 2, MaxRetries: 1}
+	start = time.Now()
+	assert.NotNil(t, c.ServeContext(context.Background(), "127.0.0.1:1", "", ""))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	assert.Equal(t, "State(9)", client.State(9).String())
+	assert.Equal(t, "State(-1)", client.State(-1).String())
+
+	// the server comes back
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", host, "", 2*time.Minute)
+	kit.E(err)
+	go func() { kit.E(s.Serve()) }()
+	c.APIHeaderHost = "digto.org"
+
+	srv := kit.MustServer("127.0.0.1:0")
+	srv.Engine.GET("/", func(ctx kit.GinContext) { ctx.String(http.StatusOK, "ok") })
+	go srv.MustDo()
+
+	states = []string{}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- c.ServeContext(ctx, srv.Listener.Addr().String(), "", "") }()
+
+	assert.Equal(t, "ok", kit.Req("http://"+host+"/").Host(c.Subdomain+".digto.org").MustString())
+	cancel()
+	assert.Equal(t, context.Canceled, <-served)
+	assert.Equal(t, []string{"connected"}, states)
+}
+
+func TestUnauthorized(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+	s.SetAdminKey("admin")
+
+	go func() { kit.E(s.Serve()) }()
+
+	c := client.New(kit.RandString(16))
+	c.APIHost = s.GetServer().Listener.Addr().String()
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+	c.Key = "nope"
+	c.Multiplex = true
+
+	// no retry with the invalid key
+	err = c.ServeContext(context.Background(), "127.0.0.1:1", "", "")
+	assert.True(t, errors.Is(err, client.ErrUnauthorized))
+	assert.EqualError(t, err, "unauthorized: invalid Digto-Key")
+
+	err = c.ServeTCPContext(context.Background(), "127.0.0.1:1")
+	assert.True(t, errors.Is(err, client.ErrUnauthorized))
+}
+
+func TestMaxInFlight(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := s.GetServer().Listener.Addr().String()
+
+	c := client.New(kit.RandString(16))
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+	c.Pollers = 4
+	c.MaxInFlight = 2
+
+	var inFlight, max int64
+	srv := kit.MustServer("127.0.0.1:0")
+	srv.Engine.GET("/", func(ctx kit.GinContext) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			m := atomic.LoadInt64(&max)
+			if n <= m || atomic.CompareAndSwapInt64(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		ctx.String(http.StatusOK, "ok")
+	})
+	go srv.MustDo()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = c.ServeContext(ctx, srv.Listener.Addr().String(), "", "") }()
+
+	const n = 6
+	wg := &sync.WaitGroup{}
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			assert.Equal(t, "ok", kit.Req("http://"+host+"/").Host(c.Subdomain+".digto.org").MustString())
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(2), atomic.LoadInt64(&max))
+}
+
+func TestServeHandler(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := s.GetServer().Listener.Addr().String()
+
+	c := client.New(kit.RandString(16))
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+
+	next := make(chan kit.Nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		kit.E(err)
+		assert.Equal(t, "/stream?a=1", r.RequestURI)
+
+		w.Header().Set("A", "B")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(body)
+		w.(http.Flusher).Flush()
+
+		<-next
+		_, _ = w.Write([]byte(" done"))
+	})
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("err")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = c.ServeHandler(ctx, mux) }()
+
+	res := kit.Req("http://" + host + "/stream?a=1").Post().StringBody("ping").Host(c.Subdomain + ".digto.org").MustResponse()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "B", res.Header.Get("A"))
+
+	// the first part arrives before the handler returns
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(res.Body, buf)
+	kit.E(err)
+	assert.Equal(t, "ping", string(buf))
+
+	next <- kit.Nil{}
+	rest, err := ioutil.ReadAll(res.Body)
+	kit.E(err)
+	assert.Equal(t, " done", string(rest))
+
+	assert.Equal(t, http.StatusNotFound, kit.Req("http://"+host+"/nope").Host(c.Subdomain+".digto.org").MustResponse().StatusCode)
+	assert.Equal(t, http.StatusInternalServerError, kit.Req("http://"+host+"/panic").Host(c.Subdomain+".digto.org").MustResponse().StatusCode)
+}
+
+func TestUpgrade(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := s.GetServer().Listener.Addr().String()
+
+	subdomain := kit.RandString(16)
+
+	c := client.New(subdomain)
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+
+	srv := kit.MustServer("127.0.0.1:0")
+
+	srv.Engine.GET("/echo", func(ctx kit.GinContext) {
+		assert.Equal(t, "echo", ctx.GetHeader("Upgrade"))
+
+		conn, buf, err := ctx.Writer.Hijack()
+		kit.E(err)
+		defer func() { _ = conn.Close() }()
+
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+		_, _ = io.Copy(conn, buf)
+	})
+
+	go srv.MustDo()
+
+	go c.Serve(srv.Listener.Addr().String(), "", "")
+
+	conn, err := net.Dial("tcp", host)
+	kit.E(err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: " + subdomain + ".digto.org\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	kit.E(err)
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	kit.E(err)
+
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "echo", res.Header.Get("Upgrade"))
+
+	_, err = conn.Write([]byte("ping"))
+	kit.E(err)
+
+	data := make([]byte, 4)
+	_, err = io.ReadFull(r, data)
+	kit.E(err)
+
+	assert.Equal(t, "ping", string(data))
+}
+
+func TestListen(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := s.GetServer().Listener.Addr().String()
+	subdomain := kit.RandString(16)
+
+	c := client.New(subdomain)
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+
+	l, err := c.Listen(context.Background())
+	kit.E(err)
+	assert.Equal(t, subdomain+"."+host, l.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hi", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		kit.E(err)
+		assert.Equal(t, int64(4), r.ContentLength)
+		_, _ = w.Write([]byte(string(body) + " " + r.Host))
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		kit.E(err)
+		defer func() { _ = conn.Close() }()
+
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+		_, _ = io.Copy(conn, buf)
+	})
+
+	served := make(chan error)
+	go func() { served <- http.Serve(l, mux) }()
+
+	assert.Equal(t, "ping "+subdomain+".digto.org",
+		kit.Req("http://"+host+"/hi").Post().StringBody("ping").Host(subdomain+".digto.org").MustString())
+
+	conn, err := net.Dial("tcp", host)
+	kit.E(err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: " + subdomain + ".digto.org\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	kit.E(err)
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	kit.E(err)
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+	_, err = conn.Write([]byte("ping"))
+	kit.E(err)
+	data := make([]byte, 4)
+	_, err = io.ReadFull(r, data)
+	kit.E(err)
+	assert.Equal(t, "ping", string(data))
+
+	kit.E(l.Close())
+	assert.Equal(t, client.ErrClosed, <-served)
+}
+
+func TestTCP(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	c := client.New(kit.RandString(16))
+	c.APIHost = s.GetServer().Listener.Addr().String()
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	kit.E(err)
+
+	go func() {
+		conn, err := local.Accept()
+		kit.E(err)
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	publicAddr, err := c.TCPAddr()
+	kit.E(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- c.ServeTCPContext(ctx, local.Addr().String()) }()
+
+	conn, err := net.Dial("tcp", publicAddr)
+	kit.E(err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = conn.Write([]byte("ping"))
+	kit.E(err)
+
+	data := make([]byte, 4)
+	_, err = io.ReadFull(conn, data)
+	kit.E(err)
+
+	assert.Equal(t, "ping", string(data))
+
+	// the ongoing connection is closed when the ctx is done
+	cancel()
+	assert.Equal(t, context.Canceled, <-served)
+	_, err = conn.Read(data)
+	assert.NotNil(t, err)
+}
+
+func TestMux(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := s.GetServer().Listener.Addr().String()
+	subdomain := kit.RandString(16)
+
+	c := client.New(subdomain)
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+
+	closed := make(chan error)
+	go func() {
+		closed <- c.Mux(func(req *http.Request, send client.Send) {
+			data, err := ioutil.ReadAll(req.Body)
+			kit.E(err)
+			kit.E(send(230, http.Header{"A": {"B"}}, bytes.NewBuffer(data)))
+		})
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+
+	const n = 10
+	wg := &sync.WaitGroup{}
+	wg.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			body := fmt.Sprint(i)
+			res := kit.Req("http://" + host + "/path").Post().StringBody(body).Host(subdomain + ".digto.org")
+
+			assert.Equal(t, body, res.MustString())
+			assert.Equal(t, 230, res.MustResponse().StatusCode)
+			assert.Equal(t, "B", res.MustResponse().Header.Get("A"))
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	kit.E(s.Shutdown(context.Background()))
+	assert.Equal(t, client.ErrMuxClosed, <-closed)
+}
+
+func TestReplay(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := s.GetServer().Listener.Addr().String()
+	subdomain := kit.RandString(16)
+
+	c := client.New(subdomain)
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+
+	consume := func(status int, body, replay string) {
+		req, send, err := c.Next()
+		kit.E(err)
+		assert.Equal(t, replay, req.Header.Get("Digto-Replay"))
+
+		data, err := ioutil.ReadAll(req.Body)
+		kit.E(err)
+		assert.Equal(t, "event", string(data))
+
+		kit.E(send(status, nil, bytes.NewBufferString(body)))
+	}
+
+	// the public can't forge the replay header
+	go consume(500, "failed", "")
+	res := kit.Req("http://"+host+"/hook").Post().StringBody("event").Host(subdomain+".digto.org").
+		Header("Digto-Replay", "forged").MustResponse()
+	assert.Equal(t, 500, res.StatusCode)
+	time.Sleep(300 * time.Millisecond)
+
+	list := kit.Req("http://"+host+"/"+subdomain+"/inspect").Query("format", "json").Host("digto.org").MustJSON()
+	id := list.Get("0.ID").String()
+
+	go consume(201, "handled", id)
+
+	res, err = c.Replay(id)
+	kit.E(err)
+
+	data, err := ioutil.ReadAll(res.Body)
+	kit.E(err)
+
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "handled", string(data))
+}
+
+func TestReplayOffline(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := s.GetServer().Listener.Addr().String()
+	subdomain := kit.RandString(16)
+
+	c := client.New(subdomain)
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+
+	// the sender gives up while no client is online
+	_, err = kit.Req("http://" + host + "/hook").Post().StringBody("event").Host(subdomain + ".digto.org").
+		Timeout(300 * time.Millisecond).Response()
+	assert.Error(t, err)
+	time.Sleep(300 * time.Millisecond)
+
+	list := kit.Req("http://"+host+"/"+subdomain+"/inspect").Query("format", "json").Host("digto.org").MustJSON()
+	id := list.Get("0.ID").String()
+	assert.False(t, list.Get("0.BodyTruncated").Bool())
+
+	go func() {
+		req, send, err := c.Next()
+		kit.E(err)
+
+		data, err := ioutil.ReadAll(req.Body)
+		kit.E(err)
+		assert.Equal(t, "event", string(data))
+
+		kit.E(send(201, nil, bytes.NewBufferString("handled")))
+	}()
+
+	res, err := c.Replay(id)
+	kit.E(err)
+
+	data, err := ioutil.ReadAll(res.Body)
+	kit.E(err)
+
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "handled", string(data))
+}
+
+func TestQueue(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := s.GetServer().Listener.Addr().String()
+	subdomain := kit.RandString(16)
+
+	c := client.New(subdomain)
+	c.APIHost = host
+	c.APIScheme = "http"
+	c.APIHeaderHost = "digto.org"
+
+	kit.E(c.EnableQueue(202))
+
+	public := func(body string) {
+		res := kit.Req("http://" + host + "/hook").Post().StringBody(body).Host(subdomain + ".digto.org").MustResponse()
+		assert.Equal(t, 202, res.StatusCode)
+		assert.NotEmpty(t, res.Header.Get("Digto-ID"))
+	}
+
+	consume := func(body string) {
+		req, send, err := c.Next()
+		kit.E(err)
+
+		data, err := ioutil.ReadAll(req.Body)
+		kit.E(err)
+		assert.Equal(t, body, string(data))
+		assert.Equal(t, "/hook", req.URL.Path)
+
+		kit.E(send(200, nil, bytes.NewBufferString("ok")))
+	}
+
+	// the waiting consumer gets the new message
+	wait := make(chan kit.Nil)
+	go func() {
+		consume("a")
+		wait <- kit.Nil{}
+	}()
+	time.Sleep(300 * time.Millisecond)
+	public("a")
+	<-wait
+
+	// the messages are kept in order while no consumer is online
+	public("b")
+	public("c")
+	consume("b")
+	consume("c")
+
+	state := kit.Req("http://" + host + "/" + subdomain + "/queue").Host("digto.org").MustJSON()
+	assert.Equal(t, int64(0), state.Get("size").Int())
+	assert.True(t, state.Get("enabled").Bool())
+
+	kit.E(c.DisableQueue())
+
+	state = kit.Req("http://" + host + "/" + subdomain + "/queue").Host("digto.org").MustJSON()
+	assert.False(t, state.Get("enabled").Bool())
+}
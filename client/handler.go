@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ysmood/kit"
+)
+
+// ServeHandler dispatches the public requests to the handler until the ctx is done, so that an existing router
+// can be mounted without a local tcp port. The response is streamed to the public as the handler writes it.
+// It has the same options and the return value as ServeContext. The http.Hijacker is not supported.
+func (c *Client) ServeHandler(ctx context.Context, handler http.Handler) error {
+	return c.dispatch(ctx, func(req *http.Request, send Send) {
+		c.handle(handler, req, send)
+	})
+}
+
+func (c *Client) handle(handler http.Handler, req *http.Request, send Send) {
+	c.Log("[access log]", kit.C(req.Method, "green"), req.URL.String())
+
+	req.RequestURI = req.URL.RequestURI()
+
+	w := &streamWriter{header: http.Header{}, send: send, done: make(chan error, 1)}
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.Log("[digto] handler panics:", r)
+			w.abort(fmt.Errorf("handler panics: %v", r))
+		}
+
+		err := w.close()
+		if err != nil {
+			c.Log(err)
+		}
+	}()
+
+	handler.ServeHTTP(w, req)
+}
+
+// streamWriter sends the header on the first write, the body is piped to the send
+type streamWriter struct {
+	header http.Header
+	send   Send
+	pipe   *io.PipeWriter
+	done   chan error
+}
+
+var _ http.Flusher = &streamWriter{}
+
+func (w *streamWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamWriter) WriteHeader(status int) {
+	if w.pipe != nil {
+		return
+	}
+
+	r, pipe := io.Pipe()
+	w.pipe = pipe
+
+	header := w.header.Clone()
+	go func() {
+		err := w.send(status, header, r)
+		_ = r.Close()
+		w.done <- err
+	}()
+}
+
+func (w *streamWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pipe.Write(data)
+}
+
+// Flush does nothing, the pipe doesn't buffer
+func (w *streamWriter) Flush() {}
+
+// abort the response, it responds 500 if the header isn't sent yet, or the public will get a broken body
+func (w *streamWriter) abort(err error) {
+	if w.pipe == nil {
+		w.header = http.Header{}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_ = w.pipe.CloseWithError(err)
+}
+
+// close finishes the body and waits for the send
+func (w *streamWriter) close() error {
+	w.WriteHeader(http.StatusOK)
+	_ = w.pipe.Close()
+	return <-w.done
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ysmood/digto/internal/netutil"
+	"github.com/ysmood/kit"
+)
+
+// ErrClosed is returned by the Accept of the closed listener
+var ErrClosed = errors.New("the listener is closed")
+
+// Listen is a drop-in replacement for net.Listen to serve http over the tunnel, such as:
+//
+//	l, _ := client.Listen(ctx, "my-subdomain")
+//	http.Serve(l, handler)
+//
+// Use Client.Listen for the other options.
+func Listen(ctx context.Context, subdomain string) (net.Listener, error) {
+	return New(subdomain).Listen(ctx)
+}
+
+// Listen returns a listener of the subdomain, each public request comes as a new connection that speaks http/1.1.
+// It has the same options as ServeContext. The listener is closed when the ctx is done.
+func (c *Client) Listen(ctx context.Context) (net.Listener, error) {
+	if c.Subdomain == "" {
+		return nil, errors.New("the subdomain is required")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	l := &listener{
+		c:      c,
+		ctx:    ctx,
+		cancel: cancel,
+		addr:   tunnelAddr(strings.TrimPrefix(c.PublicURL(), c.Scheme+"://")),
+		conns:  make(chan net.Conn),
+		done:   make(chan kit.Nil),
+	}
+
+	go func() {
+		l.err = c.dispatch(ctx, l.handle)
+		close(l.done)
+	}()
+
+	return l, nil
+}
+
+type listener struct {
+	c      *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	addr   tunnelAddr
+	conns  chan net.Conn
+
+	// done is closed when the dispatch returns, err is why it returns
+	done chan kit.Nil
+	err  error
+}
+
+var _ net.Listener = &listener{}
+
+// Accept ...
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, ErrClosed
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close stops taking new public requests, the accepted connections are not affected
+func (l *listener) Close() error {
+	l.cancel()
+	return nil
+}
+
+// Addr ...
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// handle writes the request to a new connection, then sends the response read from it
+func (l *listener) handle(req *http.Request, send Send) {
+	server, conn := net.Pipe()
+
+	select {
+	case l.conns <- &tunnelConn{server, l.addr}:
+	case <-l.ctx.Done():
+		l.c.resErr(send, ErrClosed.Error())
+		return
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	setBody(req)
+	go func() { _ = req.Write(conn) }()
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		l.c.resErr(send, err.Error())
+		return
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	var body io.Reader = res.Body
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		body = &bufferedConn{r, conn}
+	}
+
+	err = send(res.StatusCode, res.Header, body)
+	if err != nil {
+		l.c.Log(err)
+	}
+}
+
+// setBody makes the request written with the same body framing as the public request,
+// the Content-Length header is not written by the Request.Write
+func setBody(req *http.Request) {
+	n, err := strconv.ParseInt(req.Header.Get("Content-Length"), 10, 64)
+	switch {
+	case err == nil:
+		req.ContentLength = n
+	case req.Method == http.MethodGet || req.Method == http.MethodHead || netutil.IsUpgrade(req):
+		n = 0
+	default:
+		return
+	}
+	if n == 0 {
+		req.Body = http.NoBody
+	}
+}
+
+// bufferedConn reads the data already buffered by the response reader first
+type bufferedConn struct {
+	r    *bufio.Reader
+	conn net.Conn
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *bufferedConn) Write(p []byte) (int, error) { return c.conn.Write(p) }
+func (c *bufferedConn) Close() error                { return c.conn.Close() }
+
+// tunnelConn reports the public host as the addresses
+type tunnelConn struct {
+	net.Conn
+	addr tunnelAddr
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr  { return c.addr }
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.addr }
+
+type tunnelAddr string
+
+func (tunnelAddr) Network() string  { return "digto" }
+func (a tunnelAddr) String() string { return string(a) }
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ysmood/kit"
+	"golang.org/x/net/http2"
+)
+
+// Mux opens a single long-lived connection to the server, the server will push public requests
+// over it concurrently. Each request will be passed to the handler in a new goroutine,
+// the handler must call the send before it returns.
+// It returns ErrUpgrade if the server doesn't support it, it blocks until the connection is closed.
+func (c *Client) Mux(handler func(req *http.Request, send Send)) error {
+	return c.MuxContext(context.Background(), handler)
+}
+
+// MuxContext is the same as Mux, the connection is closed when the ctx is done, then it returns the ctx.Err().
+// It returns ErrMuxClosed if the server closes the connection. The ctx is also the base context of the requests.
+func (c *Client) MuxContext(ctx context.Context, handler func(req *http.Request, send Send)) error {
+	conn, err := c.upgrade(ctx, http.MethodGet, "mux")
+	if err != nil {
+		return err
+	}
+
+	closed := make(chan kit.Nil)
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-closed:
+		}
+	}()
+
+	srv := &http2.Server{}
+	srv.ServeConn(&streamConn{conn}, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req, err := http.NewRequestWithContext(r.Context(), r.Method, c.PublicURL()+r.URL.RequestURI(), r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Header = r.Header
+			req.Host = r.Host
+			req.ContentLength = r.ContentLength
+
+			handler(req, func(status int, header http.Header, body io.Reader) error {
+				for k, l := range header {
+					w.Header()[k] = l
+				}
+				w.WriteHeader(status)
+
+				if body == nil {
+					return nil
+				}
+				_, err := io.Copy(w, body)
+				return err
+			})
+		}),
+	})
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrMuxClosed
+}
+
+// streamConn adapts the upgraded stream to net.Conn
+type streamConn struct {
+	io.ReadWriteCloser
+}
+
+func (c *streamConn) LocalAddr() net.Addr                { return streamAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr               { return streamAddr{} }
+func (c *streamConn) SetDeadline(_ time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "digto" }
+func (streamAddr) String() string  { return "digto" }
@@ -2,9 +2,13 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ysmood/kit"
@@ -38,19 +42,161 @@ func (c *Client) One(handler func(kit.GinContext)) error {
 }
 
 // Serve will proxy requests to the tcp address. Default scheme is http.
+// When the server is unreachable it retries with the Backoff, it returns if the Backoff.MaxRetries is reached.
 func (c *Client) Serve(addr, overrideHost, scheme string) {
+	err := c.ServeContext(context.Background(), addr, overrideHost, scheme)
+	if err != nil {
+		c.Log(err)
+	}
+}
+
+// ServeContext is the same as Serve, it stops polling when the ctx is done, the in-flight requests to the tcp address
+// are canceled and responded with errors. It returns the ctx.Err() after all the in-flight requests are responded,
+// or the error of the last retry if the Backoff.MaxRetries is reached.
+func (c *Client) ServeContext(ctx context.Context, addr, overrideHost, scheme string) error {
 	if scheme == "" {
 		scheme = "http"
 	}
 
+	return c.dispatch(ctx, func(req *http.Request, send Send) {
+		c.serve(addr, overrideHost, scheme, req, send)
+	})
+}
+
+// dispatch the public requests to the handler with the Pollers, MaxInFlight and Backoff options until the ctx is done
+func (c *Client) dispatch(ctx context.Context, handler func(*http.Request, Send)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slots := newSlots(c.MaxInFlight)
+	wg := &sync.WaitGroup{}
+	l := c.link()
+
+	if c.Multiplex {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.serveMux(ctx, func(req *http.Request, send Send) {
+				if !slots.acquire(ctx) {
+					c.resErr(send, ctx.Err().Error())
+					return
+				}
+				defer slots.release()
+				handler(req, send)
+			})
+		}()
+	}
+
+	pollers := c.Pollers
+	if pollers < 1 {
+		pollers = 1
+	}
+	errs := make(chan error, pollers)
+	for i := 0; i < pollers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.poll(ctx, l.retry(), slots, wg, handler)
+		}()
+	}
+
+	// stop all the pollers when one of them gives up
+	err := <-errs
+	cancel()
+	wg.Wait()
+	return err
+}
+
+// poll takes a public request when a slot is free, the request is handled in a new goroutine
+func (c *Client) poll(ctx context.Context, r *retry, slots slots, wg *sync.WaitGroup, handler func(*http.Request, Send)) error {
 	for {
-		req, send, err := c.Next()
+		if !slots.acquire(ctx) {
+			return ctx.Err()
+		}
+
+		req, send, err := c.NextContext(r.attempt(ctx))
 		if err != nil {
+			slots.release()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			c.Log(err)
+			err = r.fail(ctx, err)
+			if err != nil {
+				return err
+			}
 			continue
 		}
+		r.ok()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer slots.release()
+			handler(req, send)
+		}()
+	}
+}
 
-		go c.serve(addr, overrideHost, scheme, req, send)
+// slots caps the in-flight requests, nil means no limit
+type slots chan kit.Nil
+
+func newSlots(n int) slots {
+	if n <= 0 {
+		return nil
+	}
+	return make(slots, n)
+}
+
+func (s slots) acquire(ctx context.Context) bool {
+	if s == nil {
+		return ctx.Err() == nil
+	}
+	select {
+	case s <- kit.Nil{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s slots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// serveMux reconnects with the backoff, the state and the max retries are decided by the polling
+func (c *Client) serveMux(ctx context.Context, handler func(*http.Request, Send)) {
+	failures := 0
+	for ctx.Err() == nil {
+		start := time.Now()
+		traced, connected := traceConn(ctx)
+		err := c.MuxContext(traced, handler)
+		if err == ErrUpgrade {
+			c.Log("[digto] the server doesn't support multiplexing, fallback to polling")
+			return
+		}
+		if errors.Is(err, ErrUnauthorized) {
+			// the polling gives up on it too
+			c.Log(err)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.Log(err)
+		}
+
+		if connected() && time.Since(start) > idlePoll {
+			failures = 0
+		}
+		failures++
+		select {
+		case <-time.After(c.Backoff.delay(failures)):
+		case <-ctx.Done():
+		}
 	}
 }
 
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/ysmood/digto/internal/netutil"
+	"github.com/ysmood/kit"
+)
+
+// TCPAddr returns the public tcp address of the subdomain, the port is allocated by the server on demand.
+// The port will be released if no client polls for it for a while.
+func (c *Client) TCPAddr() (string, error) {
+	res, err := resError(c.req("tcp").Response())
+	if err != nil {
+		return "", err
+	}
+	_ = res.Body.Close()
+
+	host, _, err := net.SplitHostPort(c.APIHost)
+	if err != nil {
+		host = c.APIHost
+	}
+
+	return net.JoinHostPort(host, res.Header.Get("Digto-Port")), nil
+}
+
+// NextConn gets the next tcp connection from public
+func (c *Client) NextConn() (io.ReadWriteCloser, error) {
+	return c.upgrade(context.Background(), http.MethodGet, "tcp")
+}
+
+// ServeTCP will proxy the public tcp connections to the tcp address.
+// When the server is unreachable it retries with the Backoff, it returns if the Backoff.MaxRetries is reached.
+func (c *Client) ServeTCP(addr string) {
+	err := c.ServeTCPContext(context.Background(), addr)
+	if err != nil {
+		c.Log(err)
+	}
+}
+
+// ServeTCPContext is the same as ServeTCP, it stops when the ctx is done, the ongoing tcp connections are closed.
+// It returns the ctx.Err() after they are closed, or the error of the last retry if the Backoff.MaxRetries is reached.
+func (c *Client) ServeTCPContext(ctx context.Context, addr string) error {
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	r := c.link().retry()
+	for {
+		conn, err := c.upgrade(r.attempt(ctx), http.MethodGet, "tcp")
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.Log(err)
+			err = r.fail(ctx, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		r.ok()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.serveTCP(ctx, addr, conn)
+		}()
+	}
+}
+
+func (c *Client) serveTCP(ctx context.Context, addr string, conn io.ReadWriteCloser) {
+	c.Log("[access log]", kit.C("TCP", "green"), addr)
+
+	local, err := net.Dial("tcp", addr)
+	if err != nil {
+		c.Log(err)
+		_ = conn.Close()
+		return
+	}
+
+	done := make(chan kit.Nil)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			_ = local.Close()
+		case <-done:
+		}
+	}()
+
+	netutil.Splice(conn, local)
+}
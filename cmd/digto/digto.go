@@ -1,9 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/ysmood/digto/client"
 	"github.com/ysmood/digto/server"
+	"github.com/ysmood/digto/server/cert"
 	"github.com/ysmood/kit"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
 func main() {
@@ -12,23 +26,136 @@ func main() {
 	kit.Tasks().App(app).Add(
 		kit.Task("serve", "start server").Init(serve),
 		kit.Task("proxy", "proxy a subdomain to the tcp address").Init(proxy),
+		kit.Task("tcp", "proxy raw tcp connections of a subdomain to the tcp address").Init(tcp),
+		kit.Task("reserve", "reserve a subdomain, only the token owner can consume it").Init(reserve),
+		kit.Task("queue", "store the public requests of a subdomain while no client is online").Init(queue),
+		kit.Task("domain", "route a custom domain to a reserved subdomain").Init(domain),
+		kit.Task("ca", "download the local CA certificate of a server").Init(ca),
+		kit.Task("key", "manage the api keys of a server").Init(key),
+		kit.Task("replay", "re-deliver a captured request to the current client of the subdomain").Init(replay),
 	).Do()
 }
 
 func serve(cmd kit.TaskCmd) func() {
-	dbPath := cmd.Flag("db-path", "database path").Default("digto.db").String()
-	dnsProvider := cmd.Flag("dns-provider", "dns provider name").Default("dnspod").String()
-	dnsConfig := cmd.Flag("dns-config", "dns provider config").Short('c').Required().String()
-	host := cmd.Flag("host", "host name").Short('h').Required().String()
-	caDirURL := cmd.Flag("ca-dir-url", "acme ca dir url").Short('a').String()
-	httpAddr := cmd.Flag("http-addr", "http address to listen to").Short('p').Default(":80").TCP()
-	httpsAddr := cmd.Flag("https-addr", "https address to listen to").Short('s').Default(":443").TCP()
-	timeout := cmd.Flag("timeout", "global http timeout").Short('o').Default("2m").Duration()
+	// the flags override the config only when they are set by the user
+	set := map[string]bool{}
+	flag := func(name, help string) *kingpin.FlagClause {
+		return cmd.Flag(name, help).Action(func(*kingpin.ParseContext) error {
+			set[name] = true
+			return nil
+		})
+	}
+
+	configPath := cmd.Flag("config", "yaml or json config file, the env vars such as DIGTO_HOST override it, the flags override both").String()
+	dbPath := flag("db-path", "database path").Default("digto.db").String()
+	dnsProvider := flag("dns-provider", "dns provider name, one of: "+strings.Join(cert.Providers(), ", ")).Default("dnspod").String()
+	dnsConfig := flag("dns-config", "dns provider config, the token for dnspod or a json object of the lego env vars").Short('c').String()
+	challenge := flag("challenge", "the acme challenge to obtain the certificate").Default(cert.DNS01).Enum(
+		cert.DNS01, cert.HTTP01, cert.TLSALPN01, cert.LocalCA,
+	)
+	certSubdomains := flag("cert-subdomain", "subdomain to add to the certificate for the http-01 and tls-alpn-01 challenges, can be repeated").Strings()
+	acmeEmail := flag("acme-email", "the contact email of the acme account").String()
+	certKeyType := flag("cert-key-type", "the key type of the acme certificate, one of: "+keyTypes()).Default("rsa2048").String()
+	eabKeyID := flag("acme-eab-kid", "the key id of the acme External Account Binding, required by CAs like ZeroSSL").String()
+	eabHMAC := flag("acme-eab-hmac", "the base64 hmac key of the acme External Account Binding, or the DIGTO_ACME_EAB_HMAC env").String()
+	trimChain := flag("acme-trim-chain", "cut the default certificate chain after the certificate issued by the common name, such as \"ISRG Root X1\", it doesn't select the alternate chains").String()
+	ipv4 := flag("ip", "the ipv4 source of the A records: myip, interface, a url that responds the ip, or a fixed ip").Default("myip").String()
+	ipv6 := flag("ipv6", "the ipv6 source of the AAAA records, same format as --ip, empty means no AAAA records").String()
+	ddnsInterval := flag("ddns-interval", "how often to check the ips and update the records, 0 means only on start").Default("5m").Duration()
+	host := flag("host", "host name").Short('h').String()
+	caDirURL := flag("ca-dir-url", "acme ca dir url").Short('a').String()
+	httpAddr := flag("http-addr", "http address to listen to").Short('p').Default(":80").TCP()
+	httpsAddr := flag("https-addr", "https address to listen to").Short('s').Default(":443").TCP()
+	timeout := flag("timeout", "global http timeout").Short('o').Default("2m").Duration()
+	shutdownTimeout := flag("shutdown-timeout", "max time to wait for the in-flight requests on SIGTERM or SIGINT").Default("30s").Duration()
+	maxTCPPorts := flag("max-tcp-ports", "max public ports of the raw tcp tunnels, 0 means no limit").Default("100").Int()
+	maxTCPPortsPerKey := flag("max-tcp-ports-per-key", "max public ports of the raw tcp tunnels for each api key, 0 means no limit").Default("10").Int()
+	reservationTTL := flag("reservation-ttl", "release the reserved subdomains that are not used for the duration, 0 means never").Default("0s").Duration()
+	adminKey := flag("admin-key", "enable api key authentication, the key to manage api keys, or the DIGTO_ADMIN_KEY env").String()
+	accessLog := flag("access-log", "file path to write the json access log, use - for stdout").String()
+	accessLogMaxSize := flag("access-log-max-size", "megabytes of the access log file before it gets rotated").Default("100").Int()
+	accessLogMaxBackups := flag("access-log-max-backups", "max number of the rotated access log files to keep").Default("10").Int()
+	accessLogMaxAge := flag("access-log-max-age", "max days to keep the rotated access log files").Default("30").Int()
+	clusterName := flag("cluster-name", "unique name of the node to run multiple servers behind a load balancer").String()
+	clusterURL := flag("cluster-url", "url the other nodes use to reach the node, such as http://10.0.0.2:80").String()
+	clusterCoordinator := flag("cluster-coordinator", "url of the node that keeps the shared state, empty means this node").String()
+	clusterSecret := flag("cluster-secret", "secret shared by all the nodes").String()
 
 	return func() {
-		s, err := server.New(*dbPath, *dnsProvider, *dnsConfig, *host, *caDirURL, (*httpAddr).String(), (*httpsAddr).String(), *timeout)
+		conf := server.ServeConfig()
+		if *configPath != "" {
+			var err error
+			conf, err = server.LoadConfig(*configPath)
+			kit.E(err)
+		}
+		kit.E(conf.LoadEnv())
+
+		if set["dns-config"] {
+			dns, err := cert.ParseConfig(*dnsConfig)
+			kit.E(err)
+			conf.DNSConfig = dns
+		}
+
+		for name, apply := range map[string]func(){
+			"db-path":                func() { conf.DBPath = *dbPath },
+			"dns-provider":           func() { conf.DNSProvider = *dnsProvider },
+			"challenge":              func() { conf.Challenge = *challenge },
+			"cert-subdomain":         func() { conf.CertSubdomains = *certSubdomains },
+			"acme-email":             func() { conf.ACME.Email = *acmeEmail },
+			"cert-key-type":          func() { conf.ACME.KeyType = *certKeyType },
+			"acme-eab-kid":           func() { conf.ACME.EABKeyID = *eabKeyID },
+			"acme-eab-hmac":          func() { conf.ACME.EABHMAC = *eabHMAC },
+			"acme-trim-chain":        func() { conf.ACME.TrimChain = *trimChain },
+			"ip":                     func() { conf.IP = *ipv4 },
+			"ipv6":                   func() { conf.IPv6 = *ipv6 },
+			"ddns-interval":          func() { conf.DDNSInterval = server.Duration(*ddnsInterval) },
+			"host":                   func() { conf.Host = *host },
+			"ca-dir-url":             func() { conf.CADirURL = *caDirURL },
+			"http-addr":              func() { conf.HTTPAddr = (*httpAddr).String() },
+			"https-addr":             func() { conf.HTTPSAddr = (*httpsAddr).String() },
+			"timeout":                func() { conf.Timeout = server.Duration(*timeout) },
+			"shutdown-timeout":       func() { conf.ShutdownTimeout = server.Duration(*shutdownTimeout) },
+			"max-tcp-ports":          func() { conf.MaxTCPPorts = *maxTCPPorts },
+			"max-tcp-ports-per-key":  func() { conf.MaxTCPPortsPerKey = *maxTCPPortsPerKey },
+			"reservation-ttl":        func() { conf.ReservationTTL = server.Duration(*reservationTTL) },
+			"admin-key":              func() { conf.AdminKey = *adminKey },
+			"access-log":             func() { conf.AccessLog.Path = *accessLog },
+			"access-log-max-size":    func() { conf.AccessLog.MaxSize = *accessLogMaxSize },
+			"access-log-max-backups": func() { conf.AccessLog.MaxBackups = *accessLogMaxBackups },
+			"access-log-max-age":     func() { conf.AccessLog.MaxAge = *accessLogMaxAge },
+			"cluster-name":           func() { conf.Cluster.Name = *clusterName },
+			"cluster-url":            func() { conf.Cluster.URL = *clusterURL },
+			"cluster-coordinator":    func() { conf.Cluster.Coordinator = *clusterCoordinator },
+			"cluster-secret":         func() { conf.Cluster.Secret = *clusterSecret },
+		} {
+			if set[name] {
+				apply()
+			}
+		}
+
+		s, err := server.NewWithConfig(conf)
 		kit.E(err)
+
+		done := make(chan struct{})
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+			<-sig
+			signal.Stop(sig)
+
+			kit.Log("[digto] shutting down")
+			c, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeout))
+			defer cancel()
+			err := s.Shutdown(c)
+			if err != nil {
+				kit.Err("[digto] shutdown:", err)
+				os.Exit(1)
+			}
+			close(done)
+		}()
+
 		kit.E(s.Serve())
+		<-done
 	}
 }
 
@@ -42,6 +169,11 @@ func proxy(cmd kit.TaskCmd) func() {
 		"http", "https",
 	)
 	accessLog := cmd.Flag("access-log", "whether to print access log or not").Short('l').Bool()
+	mux := cmd.Flag("mux", "receive requests over a single multiplexed connection").Short('m').Bool()
+	pollers := cmd.Flag("pollers", "number of the parallel long polls").Default("1").Int()
+	maxInFlight := cmd.Flag("max-in-flight", "max requests to forward to addr at the same time, 0 means no limit").Int()
+	setAuth := authFlags(cmd)
+	setBackoff := backoffFlags(cmd)
 
 	return func() {
 		if *subdomain == "" {
@@ -49,6 +181,11 @@ func proxy(cmd kit.TaskCmd) func() {
 		}
 
 		c := client.New(*subdomain)
+		c.Multiplex = *mux
+		c.Pollers = *pollers
+		c.MaxInFlight = *maxInFlight
+		setAuth(c)
+		setBackoff(c)
 
 		if *accessLog {
 			c.Log = func(s ...interface{}) {
@@ -59,6 +196,228 @@ func proxy(cmd kit.TaskCmd) func() {
 		addr := (*addr).String()
 
 		kit.Log("digto client:", c.PublicURL(), kit.C("->", "cyan"), addr)
-		c.Serve(addr, *hostHeader, *scheme)
+		kit.E(c.ServeContext(context.Background(), addr, *hostHeader, *scheme))
+	}
+}
+
+func tcp(cmd kit.TaskCmd) func() {
+	subdomain := cmd.Arg("subdomain", "the subdomain to use, default is random string").String()
+	addr := cmd.Arg("addr", "the tcp address to proxy to").Default(":3000").TCP()
+	accessLog := cmd.Flag("access-log", "whether to print access log or not").Short('l').Bool()
+	setAuth := authFlags(cmd)
+	setBackoff := backoffFlags(cmd)
+
+	return func() {
+		if *subdomain == "" {
+			*subdomain = kit.RandString(4)
+		}
+
+		c := client.New(*subdomain)
+		setAuth(c)
+		setBackoff(c)
+
+		if *accessLog {
+			c.Log = func(s ...interface{}) {
+				kit.Log(s...)
+			}
+		}
+
+		publicAddr, err := c.TCPAddr()
+		kit.E(err)
+
+		addr := (*addr).String()
+
+		kit.Log("digto client:", "tcp://"+publicAddr, kit.C("->", "cyan"), addr)
+		c.ServeTCP(addr)
+	}
+}
+
+func reserve(cmd kit.TaskCmd) func() {
+	subdomain := cmd.Arg("subdomain", "the subdomain to reserve").Required().String()
+	release := cmd.Flag("release", "release the reserved subdomain, the token is required").Short('r').Bool()
+	setAuth := authFlags(cmd)
+
+	return func() {
+		c := client.New(*subdomain)
+		setAuth(c)
+
+		if *release {
+			kit.E(c.Release())
+			kit.Log("released:", *subdomain)
+			return
+		}
+
+		token, err := c.Reserve()
+		kit.E(err)
+		kit.Log("reserved:", *subdomain, "token:", token)
+	}
+}
+
+func queue(cmd kit.TaskCmd) func() {
+	subdomain := cmd.Arg("subdomain", "the subdomain to queue").Required().String()
+	status := cmd.Flag("status", "the status to respond the public requests after they are queued").Default("202").Int()
+	disable := cmd.Flag("disable", "stop queuing, the queued requests will still be delivered").Short('d').Bool()
+	setAuth := authFlags(cmd)
+
+	return func() {
+		c := client.New(*subdomain)
+		setAuth(c)
+
+		if *disable {
+			kit.E(c.DisableQueue())
+			kit.Log("queue disabled:", *subdomain)
+			return
+		}
+
+		kit.E(c.EnableQueue(*status))
+		kit.Log("queue enabled:", *subdomain, "status:", *status)
+	}
+}
+
+func keyTypes() string {
+	list := []string{}
+	for name := range cert.KeyTypes {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+func domain(cmd kit.TaskCmd) func() {
+	subdomain := cmd.Arg("subdomain", "the reserved subdomain").Required().String()
+	name := cmd.Arg("domain", "the custom domain, its CNAME must point to the subdomain").Required().String()
+	remove := cmd.Flag("remove", "stop routing the domain").Short('r').Bool()
+	setAuth := authFlags(cmd)
+
+	return func() {
+		c := client.New(*subdomain)
+		setAuth(c)
+
+		if *remove {
+			kit.E(c.RemoveDomain(*name))
+			kit.Log("domain removed:", *name)
+			return
+		}
+
+		kit.E(c.AddDomain(*name))
+		kit.Log("domain added:", *name, "->", *subdomain)
+	}
+}
+
+func ca(cmd kit.TaskCmd) func() {
+	api := apiFlag(cmd, "http://digto.org")
+	out := cmd.Flag("out", "the file to write the pem to, default is stdout").Short('o').String()
+
+	return func() {
+		res, err := kit.Req((*api).String() + "/-/ca").Response()
+		kit.E(err)
+		defer func() { _ = res.Body.Close() }()
+
+		if msg := res.Header.Get("Digto-Error"); msg != "" {
+			kit.E(errors.New(msg))
+		}
+
+		pem, err := ioutil.ReadAll(res.Body)
+		kit.E(err)
+
+		if *out == "" {
+			_, err = os.Stdout.Write(pem)
+			kit.E(err)
+			return
+		}
+		kit.E(ioutil.WriteFile(*out, pem, 0644))
+	}
+}
+
+// apiFlag adds the flag of the server to the cmd
+func apiFlag(cmd kit.TaskCmd, def string) **url.URL {
+	return cmd.Flag("api", "the url of the api host of the server, such as https://test.com").
+		Default(def).Envar("DIGTO_API").URL()
+}
+
+// authFlags adds the server and auth flags to the cmd, the returned function sets them to the client
+func authFlags(cmd kit.TaskCmd) func(*client.Client) {
+	api := apiFlag(cmd, "https://digto.org")
+	token := cmd.Flag("token", "the token of the reserved subdomain").Short('t').Envar("DIGTO_TOKEN").String()
+	key := cmd.Flag("key", "the api key of the server").Short('k').Envar("DIGTO_KEY").String()
+
+	return func(c *client.Client) {
+		c.Scheme = (*api).Scheme
+		c.APIScheme = (*api).Scheme
+		c.APIHost = (*api).Host
+		c.APIHeaderHost = (*api).Hostname()
+		c.Token = *token
+		c.Key = *key
+	}
+}
+
+func backoffFlags(cmd kit.TaskCmd) func(*client.Client) {
+	maxRetries := cmd.Flag("max-retries", "give up after the number of consecutive failures to reach the server, 0 means never").Int()
+	maxBackoff := cmd.Flag("max-backoff", "max delay between the retries when the server is unreachable").Default("30s").Duration()
+
+	return func(c *client.Client) {
+		c.Backoff.MaxRetries = *maxRetries
+		c.Backoff.Max = *maxBackoff
+		c.OnState = func(state client.State, err error) {
+			switch state {
+			case client.StateConnected:
+				kit.Log("[digto] connected")
+			case client.StateDisconnected:
+				kit.Err("[digto] disconnected", err)
+			}
+		}
+	}
+}
+
+func key(cmd kit.TaskCmd) func() {
+	action := cmd.Arg("action", "the action to run").Required().Enum("create", "list", "revoke")
+	id := cmd.Arg("id", "the id of the key to revoke").String()
+	api := apiFlag(cmd, "https://digto.org")
+	adminKey := cmd.Flag("admin-key", "the admin key of the server").Envar("DIGTO_ADMIN_KEY").Required().String()
+	name := cmd.Flag("name", "the name of the key to create").String()
+	maxSubdomains := cmd.Flag("max-subdomains", "the max number of subdomains the key can consume at the same time").Int()
+	maxRequests := cmd.Flag("max-requests", "the max number of api requests the key can make").Int()
+
+	return func() {
+		u := (*api).String() + "/-/keys"
+		req := kit.Req(u).Header("Digto-Admin-Key", *adminKey)
+
+		switch *action {
+		case "create":
+			req.Post().Query(
+				"name", *name,
+				"max-subdomains", strconv.Itoa(*maxSubdomains),
+				"max-requests", strconv.Itoa(*maxRequests),
+			)
+		case "revoke":
+			req.URL(u + "/" + *id).Delete()
+		}
+
+		res := req.MustResponse()
+		if msg := res.Header.Get("Digto-Error"); msg != "" {
+			kit.E(errors.New(msg))
+		}
+		kit.Log(req.MustString())
+	}
+}
+
+func replay(cmd kit.TaskCmd) func() {
+	subdomain := cmd.Arg("subdomain", "the subdomain of the request").Required().String()
+	id := cmd.Arg("id", "the id of the request, check it on the inspect page").Required().String()
+	setAuth := authFlags(cmd)
+
+	return func() {
+		c := client.New(*subdomain)
+		setAuth(c)
+
+		res, err := c.Replay(*id)
+		kit.E(err)
+		defer func() { _ = res.Body.Close() }()
+
+		body, err := ioutil.ReadAll(res.Body)
+		kit.E(err)
+
+		kit.Log("status:", res.StatusCode)
+		kit.Log(string(body))
 	}
 }
@@ -3,11 +3,15 @@ module github.com/ysmood/digto
 go 1.14
 
 require (
+	github.com/aws/aws-sdk-go v1.30.20
 	github.com/gin-gonic/gin v1.6.3
 	github.com/go-acme/lego/v3 v3.7.0
 	github.com/stretchr/testify v1.5.1
-	github.com/ysmood/ddns v0.2.3
 	github.com/ysmood/kit v0.22.3
 	github.com/ysmood/myip v1.0.0
 	github.com/ysmood/storer v0.1.1
+	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
+	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v2 v2.2.8
 )
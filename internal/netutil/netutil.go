@@ -0,0 +1,40 @@
+// Package netutil has the connection helpers shared by the server and the client
+package netutil
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ysmood/kit"
+)
+
+// IsUpgrade returns true if the request asks to switch protocols, such as WebSocket
+func IsUpgrade(req *http.Request) bool {
+	for _, v := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// Splice copies data between a and b in both directions until either side is done,
+// then closes both of them if they are io.Closer
+func Splice(a, b io.ReadWriter) {
+	done := make(chan kit.Nil, 2)
+	cp := func(dst io.Writer, src io.Reader) {
+		_, _ = io.Copy(dst, src)
+		done <- kit.Nil{}
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+
+	for _, rw := range []io.ReadWriter{a, b} {
+		if c, ok := rw.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ysmood/kit"
+)
+
+// accessEntry is the summary of a public request or a consumer api request,
+// it's written to the access log as a json line
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Subdomain string    `json:"subdomain"`
+	Action    string    `json:"action,omitempty"`
+
+	// ID the Digto-ID of the public request, for api requests it's the one consumed or responded
+	ID string `json:"id,omitempty"`
+
+	// Key the id of the api key
+	Key string `json:"key,omitempty"`
+
+	Method     string `json:"method"`
+	URL        string `json:"url"`
+	RemoteAddr string `json:"remote_addr"`
+	Status     int    `json:"status"`
+	Error      string `json:"error,omitempty"`
+
+	// Duration in milliseconds
+	Duration float64 `json:"duration_ms"`
+
+	// Wait the milliseconds the public request waits until a consumer takes it
+	Wait float64 `json:"wait_ms,omitempty"`
+
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	ctx  kit.GinContext
+	body *countReader
+}
+
+// accessLog writes the entries as json lines, nil means disabled
+type accessLog struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func newAccessLog(out io.Writer) *accessLog {
+	return &accessLog{out: out}
+}
+
+func (l *accessLog) write(e *accessEntry) {
+	if l == nil {
+		return
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		kit.Err(err)
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, err = l.out.Write(append(data, '\n'))
+	if err != nil {
+		kit.Err(err)
+	}
+}
+
+// track starts the entry of the request, the kind is "public" or "api", pass it to finish after the request is done
+func (p *proxy) track(ctx kit.GinContext, kind, subdomain string) *accessEntry {
+	e := &accessEntry{
+		Time:       time.Now(),
+		Kind:       kind,
+		Subdomain:  subdomain,
+		Method:     ctx.Request.Method,
+		URL:        redactURL(ctx.Request.URL),
+		RemoteAddr: ctx.Request.RemoteAddr,
+		ctx:        ctx,
+		body:       &countReader{r: ctx.Request.Body},
+	}
+	ctx.Request.Body = e.body
+	return e
+}
+
+// secretQueries are the auth values that should never be logged
+var secretQueries = []string{"Digto-Key", "Digto-Token", "Digto-Admin-Key"}
+
+// redactURL hides the values of the secretQueries
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	redacted := false
+	for _, name := range secretQueries {
+		if _, has := q[name]; has {
+			q.Set(name, "redacted")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// finish records the entry to the metrics and the access log
+func (p *proxy) finish(e *accessEntry) {
+	header := e.ctx.Writer.Header()
+
+	if e.ID == "" {
+		e.ID = e.ctx.GetHeader("Digto-ID")
+	}
+	if e.ID == "" {
+		e.ID = header.Get("Digto-ID")
+	}
+	e.Status = e.ctx.Writer.Status()
+	e.Error = header.Get("Digto-Error")
+	e.Duration = milliseconds(time.Since(e.Time))
+	e.BytesIn = e.body.n
+	if size := e.ctx.Writer.Size(); size > 0 {
+		e.BytesOut = int64(size)
+	}
+
+	p.metrics.count(e)
+	p.accessLog.write(e)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// countReader counts the bytes read
+type countReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countReader) Close() error {
+	return c.r.Close()
+}
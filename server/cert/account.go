@@ -0,0 +1,221 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-acme/lego/v3/certcrypto"
+	"github.com/go-acme/lego/v3/lego"
+	"github.com/go-acme/lego/v3/registration"
+)
+
+// KeyTypes maps the names of the certificate key types to the lego ones
+var KeyTypes = map[string]certcrypto.KeyType{
+	"ec256":   certcrypto.EC256,
+	"ec384":   certcrypto.EC384,
+	"rsa2048": certcrypto.RSA2048,
+	"rsa4096": certcrypto.RSA4096,
+	"rsa8192": certcrypto.RSA8192,
+}
+
+// Account settings of the ACME
+type Account struct {
+	// Email the contact email of the account, optional
+	Email string `json:"email" yaml:"email"`
+
+	// KeyType the name of the key type of the acme certificates, check KeyTypes, default is "rsa2048"
+	KeyType string `json:"key_type" yaml:"key_type"`
+
+	// EABKeyID and EABHMAC are the External Account Binding, required by some CAs such as ZeroSSL
+	EABKeyID string `json:"eab_kid" yaml:"eab_kid"`
+	EABHMAC  string `json:"eab_hmac" yaml:"eab_hmac"`
+
+	// TrimChain the common name of an issuer in the default chain, such as "ISRG Root X1", the chain is cut
+	// after the certificate issued by it, nothing changes if there's no such certificate in the chain.
+	// It doesn't select the alternate chains of the CA.
+	TrimChain string `json:"trim_chain" yaml:"trim_chain"`
+}
+
+// Validate the settings
+func (a Account) Validate() error {
+	_, err := a.keyType()
+	return err
+}
+
+func (a Account) keyType() (certcrypto.KeyType, error) {
+	if a.KeyType == "" {
+		return certcrypto.RSA2048, nil
+	}
+
+	t, has := KeyTypes[strings.ToLower(a.KeyType)]
+	if !has {
+		list := []string{}
+		for name := range KeyTypes {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		return "", fmt.Errorf("key type not supported: %s, the supported ones are: %s", a.KeyType, strings.Join(list, ", "))
+	}
+	return t, nil
+}
+
+type accountData struct {
+	CADirURL     string
+	Key          []byte
+	Registration *registration.Resource
+	Email        string
+	EABKeyID     string
+}
+
+// loadAccount restores the account of the CA from the AccountCache, the account of the caches that are created
+// before the AccountCache exists is moved to it
+func (ctx *Context) loadAccount() error {
+	if ctx.opts.AccountCache == nil {
+		return nil
+	}
+
+	data, err := ctx.opts.AccountCache.Get()
+	if err != nil {
+		return err
+	}
+
+	var acc accountData
+	if len(data) != 0 {
+		err = json.Unmarshal(data, &acc)
+		if err != nil {
+			return err
+		}
+	}
+
+	if acc.Registration == nil || acc.CADirURL != ctx.caDirURL {
+		if ctx.registration != nil {
+			return ctx.saveAccount()
+		}
+		return nil
+	}
+
+	key, err := x509.ParseECPrivateKey(acc.Key)
+	if err != nil {
+		return err
+	}
+
+	ctx.key = key
+	ctx.registration = acc.Registration
+	ctx.registeredEmail = acc.Email
+	ctx.registeredKID = acc.EABKeyID
+	return nil
+}
+
+func (ctx *Context) saveAccount() error {
+	if ctx.opts.AccountCache == nil {
+		return nil
+	}
+
+	key, _ := x509.MarshalECPrivateKey(ctx.key)
+	data, _ := json.Marshal(accountData{
+		CADirURL:     ctx.caDirURL,
+		Key:          key,
+		Registration: ctx.registration,
+		Email:        ctx.registeredEmail,
+		EABKeyID:     ctx.registeredKID,
+	})
+	return ctx.opts.AccountCache.Set(data)
+}
+
+// prepareAccount picks up the account registered by the other contexts that share the AccountCache,
+// and drops the account if the EAB key id changes, the new key id can only be bound to a new account key
+func (ctx *Context) prepareAccount() error {
+	if ctx.registration == nil || ctx.registeredKID != ctx.account.EABKeyID {
+		err := ctx.loadAccount()
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.registration == nil || ctx.registeredKID == ctx.account.EABKeyID {
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	ctx.key = key
+	ctx.registration = nil
+	return nil
+}
+
+// register the acme account if it's not registered yet, the registration is persisted with the AccountCache
+func (ctx *Context) register(client *lego.Client) error {
+	var reg *registration.Resource
+	var err error
+
+	switch {
+	case ctx.registration != nil && ctx.registeredEmail == ctx.account.Email:
+		return nil
+	case ctx.registration != nil:
+		reg, err = client.Registration.UpdateRegistration(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	case ctx.account.EABKeyID != "":
+		reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: true,
+			Kid:                  ctx.account.EABKeyID,
+			HmacEncoded:          ctx.account.EABHMAC,
+		})
+	default:
+		reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx.registration = reg
+	ctx.registeredEmail = ctx.account.Email
+	ctx.registeredKID = ctx.account.EABKeyID
+	return ctx.saveAccount()
+}
+
+// trimChain cuts the pem bundle after the certificate issued by the name
+func trimChain(bundle []byte, name string) []byte {
+	if name == "" {
+		return bundle
+	}
+
+	certs, err := certcrypto.ParsePEMBundle(bundle)
+	if err != nil {
+		return bundle
+	}
+
+	for i, c := range certs {
+		if c.Issuer.CommonName == name {
+			out := []byte{}
+			for _, c := range certs[:i+1] {
+				out = append(out, certcrypto.PEMEncode(certcrypto.DERCertificateBytes(c.Raw))...)
+			}
+			return out
+		}
+	}
+	return bundle
+}
+
+type user struct {
+	email        string
+	key          crypto.PrivateKey
+	registration *registration.Resource
+}
+
+func (u *user) GetEmail() string {
+	return u.email
+}
+func (u user) GetRegistration() *registration.Resource {
+	return u.registration
+}
+func (u *user) GetPrivateKey() crypto.PrivateKey {
+	return u.key
+}
@@ -0,0 +1,87 @@
+package cert
+
+import (
+	"testing"
+
+	"github.com/go-acme/lego/v3/certcrypto"
+	"github.com/go-acme/lego/v3/registration"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccount(t *testing.T) {
+	keyType, err := Account{}.keyType()
+	assert.Nil(t, err)
+	assert.Equal(t, certcrypto.RSA2048, keyType)
+
+	keyType, err = Account{KeyType: "EC256"}.keyType()
+	assert.Nil(t, err)
+	assert.Equal(t, certcrypto.EC256, keyType)
+
+	_, err = New(Options{Host: "digto.org", Challenge: HTTP01, Account: Account{KeyType: "nope"}})
+	assert.EqualError(t, err, "key type not supported: nope, the supported ones are: ec256, ec384, rsa2048, rsa4096, rsa8192")
+
+	// the cached cert is dropped if the key type changes
+	local, err := New(Options{Host: "digto.org", Challenge: LocalCA, Cache: &memCache{}, CACache: &memCache{}})
+	assert.Nil(t, err)
+	local.registeredEmail = "a@digto.org"
+
+	ctx := &Context{challenge: HTTP01, keyType: certcrypto.RSA2048}
+	challenge, err := ctx.unmarshal(local.marshal())
+	assert.Nil(t, err)
+	assert.Equal(t, LocalCA, challenge)
+	assert.NotNil(t, ctx.Cert())
+	assert.Equal(t, "a@digto.org", ctx.registeredEmail)
+
+	ctx = &Context{challenge: HTTP01, keyType: certcrypto.EC256}
+	_, err = ctx.unmarshal(local.marshal())
+	assert.Nil(t, err)
+	assert.Nil(t, ctx.Cert())
+}
+
+func TestTrimChain(t *testing.T) {
+	ctx, err := New(Options{Host: "digto.org", Challenge: LocalCA, Cache: &memCache{}, CACache: &memCache{}})
+	assert.Nil(t, err)
+
+	bundle := ctx.legoCert.Certificate
+	certs, err := certcrypto.ParsePEMBundle(bundle)
+	assert.Nil(t, err)
+	assert.Len(t, certs, 2)
+
+	assert.Equal(t, bundle, trimChain(bundle, ""))
+	assert.Equal(t, bundle, trimChain(bundle, "nope"))
+
+	certs, err = certcrypto.ParsePEMBundle(trimChain(bundle, "Digto Local CA digto.org"))
+	assert.Nil(t, err)
+	assert.Len(t, certs, 1)
+	assert.Equal(t, "digto.org", certs[0].Subject.CommonName)
+}
+
+func TestAccountCache(t *testing.T) {
+	accountCache := &memCache{}
+
+	ctx, err := New(Options{Host: "digto.org", Challenge: HTTP01, Cache: &memCache{}, AccountCache: accountCache})
+	assert.Nil(t, err)
+	ctx.registration = &registration.Resource{URI: "account"}
+	ctx.registeredEmail = "a@digto.org"
+	assert.Nil(t, ctx.saveAccount())
+
+	// the account is kept when the cert cache is reset
+	other, err := New(Options{Host: "other.org", Challenge: HTTP01, Cache: &memCache{}, AccountCache: accountCache})
+	assert.Nil(t, err)
+	assert.Equal(t, "account", other.registration.URI)
+	assert.Equal(t, "a@digto.org", other.registeredEmail)
+	assert.True(t, ctx.key.Equal(other.key))
+
+	// a new account for the new eab key id
+	other.account.EABKeyID = "kid"
+	assert.Nil(t, other.prepareAccount())
+	assert.Nil(t, other.registration)
+	assert.False(t, ctx.key.Equal(other.key))
+
+	// the account of another CA is not used
+	other, err = New(Options{
+		Host: "digto.org", Challenge: HTTP01, CADirURL: "http://ca", Cache: &memCache{}, AccountCache: accountCache,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, other.registration)
+}
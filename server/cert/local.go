@@ -0,0 +1,169 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/go-acme/lego/v3/certcrypto"
+	"github.com/go-acme/lego/v3/certificate"
+)
+
+// the lifetime of the certificates issued by the local CA
+const localCertLifetime = 90 * 24 * time.Hour
+
+// ErrNoCACache ...
+var ErrNoCACache = errors.New("the cache of the local CA is required")
+
+type localCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+type caData struct {
+	Cert []byte
+	Key  []byte
+}
+
+// loadCA loads the local CA from the CA cache, generates a new one if there's none
+func (ctx *Context) loadCA(cache Cache) error {
+	if cache == nil {
+		return ErrNoCACache
+	}
+
+	data, err := cache.Get()
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		data, err = newCA(ctx.host)
+		if err != nil {
+			return err
+		}
+		err = cache.Set(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ca caData
+	err = json.Unmarshal(data, &ca)
+	if err != nil {
+		return err
+	}
+
+	cert, err := certcrypto.ParsePEMCertificate(ca.Cert)
+	if err != nil {
+		return err
+	}
+	key, err := certcrypto.ParsePEMPrivateKey(ca.Key)
+	if err != nil {
+		return err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("the key of the local CA must be ecdsa")
+	}
+
+	ctx.ca = &localCA{cert: cert, key: ecKey, pem: ca.Cert}
+	return nil
+}
+
+// newCA generates a self-signed root CA
+func newCA(host string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Digto Local CA " + host, Organization: []string{"Digto"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(caData{
+		Cert: certcrypto.PEMEncode(certcrypto.DERCertificateBytes(der)),
+		Key:  certcrypto.PEMEncode(key),
+	})
+}
+
+// issue a certificate for the domains with the local CA
+func (ctx *Context) issue() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: ctx.host},
+		DNSNames:     ctx.domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(localCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ctx.ca.cert, &key.PublicKey, ctx.ca.key)
+	if err != nil {
+		return err
+	}
+
+	ctx.legoCert = &certificate.Resource{
+		Domain:            ctx.host,
+		Certificate:       append(certcrypto.PEMEncode(certcrypto.DERCertificateBytes(der)), ctx.ca.pem...),
+		PrivateKey:        certcrypto.PEMEncode(key),
+		IssuerCertificate: ctx.ca.pem,
+	}
+	ctx.lastObtain = time.Now()
+
+	err = ctx.updateCert()
+	if err != nil {
+		return err
+	}
+	if ctx.cache != nil {
+		return ctx.cache.Set(ctx.marshal())
+	}
+	return nil
+}
+
+// CA returns the pem of the local CA certificate, nil if the context is not in the LocalCA mode
+func (ctx *Context) CA() []byte {
+	if ctx == nil || ctx.ca == nil {
+		return nil
+	}
+	return ctx.ca.pem
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,64 @@
+package cert
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memCache struct {
+	data []byte
+}
+
+func (c *memCache) Get() ([]byte, error) { return c.data, nil }
+
+func (c *memCache) Set(data []byte) error {
+	c.data = data
+	return nil
+}
+
+func TestLocalCA(t *testing.T) {
+	caCache := &memCache{}
+
+	ctx, err := New(Options{Host: "digto.org", Challenge: LocalCA, Cache: &memCache{}, CACache: caCache})
+	assert.Nil(t, err)
+
+	roots := x509.NewCertPool()
+	assert.True(t, roots.AppendCertsFromPEM(ctx.CA()))
+
+	leaf, err := x509.ParseCertificate(ctx.Cert().Certificate[0])
+	assert.Nil(t, err)
+	for _, name := range []string{"digto.org", "a.digto.org"} {
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		assert.Nil(t, err)
+	}
+
+	// the CA is reused after restart
+	other, err := New(Options{Host: "digto.org", Challenge: LocalCA, Cache: &memCache{}, CACache: caCache})
+	assert.Nil(t, err)
+	assert.Equal(t, ctx.CA(), other.CA())
+
+	_, err = New(Options{Host: "digto.org", Challenge: LocalCA})
+	assert.Equal(t, ErrNoCACache, err)
+}
+
+func TestCacheChallenge(t *testing.T) {
+	cache := &memCache{}
+
+	ctx, err := New(Options{Host: "digto.org", Challenge: LocalCA, Cache: cache, CACache: &memCache{}})
+	assert.Nil(t, err)
+	assert.NotNil(t, ctx.Cert())
+	assert.NotEmpty(t, cache.data)
+
+	// the local one won't be used for the dns-01
+	ctx, err = New(Options{
+		Host:     "digto.org",
+		Provider: "rfc2136",
+		Config:   map[string]string{"RFC2136_NAMESERVER": "127.0.0.1:53"},
+		Cache:    cache,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, ctx.Cert())
+	assert.Empty(t, cache.data)
+}
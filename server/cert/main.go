@@ -1,11 +1,13 @@
 package cert
 
 import (
-	"crypto"
 	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"crypto/elliptic"
@@ -15,24 +17,40 @@ import (
 	"github.com/go-acme/lego/v3/certificate"
 	"github.com/go-acme/lego/v3/challenge"
 	"github.com/go-acme/lego/v3/lego"
-	"github.com/go-acme/lego/v3/providers/dns/dnspod"
 	"github.com/go-acme/lego/v3/registration"
 )
 
-const month = time.Hour * 24 * 30
-
 // Context ...
 type Context struct {
-	host         string
-	key          *ecdsa.PrivateKey
-	lastObtain   time.Time
-	legoCert     *certificate.Resource
-	cert         *tls.Certificate
-	providerName string
-	token        string
-	cache        Cache
+	host       string
+	domains    []string
+	key        *ecdsa.PrivateKey
+	lastObtain time.Time
+	legoCert   *certificate.Resource
+	cert       *tls.Certificate
+	challenge  string
+	provider   challenge.Provider
+	cache      Cache
+	httpSolver *httpSolver
+	tlsSolver  *tlsSolver
+	ca         *localCA
+	opts       Options
+	account    Account
+	keyType    certcrypto.KeyType
+
+	registration    *registration.Resource
+	registeredEmail string
+	registeredKID   string
 
 	caDirURL string
+
+	// lock guards the cert and the renewal state, the cert is read by the tls handshakes while it's being renewed
+	lock        sync.RWMutex
+	updateLock  sync.Mutex
+	lastAttempt time.Time
+	nextAttempt time.Time
+	lastError   error
+	failures    int
 }
 
 // Cache ...
@@ -41,36 +59,110 @@ type Cache interface {
 	Set([]byte) error
 }
 
-// New cache arg is optional
-func New(host, providerName, token, caDirURL string, cache Cache) (*Context, error) {
+// Options ...
+type Options struct {
+	Host string
+
+	// Challenge to obtain the certificate, default is DNS01, or LocalCA to issue it locally
+	Challenge string
+
+	// Provider the dns provider for the DNS01 challenge, the Config is passed to it, check NewProvider
+	Provider string
+	Config   map[string]string
+
+	// Subdomains to add to the certificate for the HTTP01 and TLSALPN01 challenges,
+	// they can't obtain the wildcard certificate like the DNS01
+	Subdomains []string
+
+	CADirURL string
+
+	// Cache is optional
+	Cache Cache
+
+	// CACache stores the local CA, required by LocalCA
+	CACache Cache
+
+	// AccountCache stores the acme account, it's kept when the Cache is reset, so that a new account
+	// isn't registered each time the domains change. It can be shared by the contexts of the same CA, optional
+	AccountCache Cache
+
+	// Account settings of the ACME
+	Account Account
+}
+
+// New creates the certificate context. With LocalCA the certificate will be issued before it returns,
+// with the acme challenges call Update to obtain it, the HTTP01 and TLSALPN01 need the digto server to respond them.
+func New(opts Options) (*Context, error) {
+	if opts.Challenge == "" {
+		opts.Challenge = DNS01
+	}
+
+	keyType, err := opts.Account.keyType()
+	if err != nil {
+		return nil, err
+	}
+
 	ctx := &Context{
-		providerName: providerName,
-		token:        token,
-		host:         host,
-		cache:        cache,
-		caDirURL:     caDirURL,
+		host:       opts.Host,
+		challenge:  opts.Challenge,
+		cache:      opts.Cache,
+		caDirURL:   opts.CADirURL,
+		opts:       opts,
+		account:    opts.Account,
+		keyType:    keyType,
+		httpSolver: &httpSolver{tokens: map[string]string{}},
+		tlsSolver:  &tlsSolver{certs: map[string]*tls.Certificate{}},
+	}
+
+	switch opts.Challenge {
+	case DNS01:
+		provider, err := NewProvider(opts.Provider, opts.Config)
+		if err != nil {
+			return nil, err
+		}
+		ctx.provider = provider
+		ctx.domains = []string{"*." + opts.Host, opts.Host}
+	case LocalCA:
+		ctx.domains = []string{"*." + opts.Host, opts.Host}
+		err := ctx.loadCA(opts.CACache)
+		if err != nil {
+			return nil, err
+		}
+	case HTTP01, TLSALPN01:
+		ctx.domains = []string{opts.Host}
+		for _, s := range opts.Subdomains {
+			ctx.domains = append(ctx.domains, s+"."+opts.Host)
+		}
+	default:
+		return nil, fmt.Errorf("challenge not supported: %s", opts.Challenge)
 	}
 
 	var data []byte
-	if cache != nil {
-		var err error
-		data, err = cache.Get()
+	if opts.Cache != nil {
+		data, err = opts.Cache.Get()
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if len(data) != 0 {
-		err := ctx.unmarshal(data)
+		domains := ctx.domains
+		challenge, err := ctx.unmarshal(data)
 		if err != nil {
 			return nil, err
 		}
-		if ctx.host != host || ctx.caDirURL != caDirURL {
-			err = cache.Set(nil)
+		if challenge != opts.Challenge || ctx.caDirURL != opts.CADirURL ||
+			strings.Join(ctx.domains, ",") != strings.Join(domains, ",") {
+			// keep the account of the cache before it's reset
+			err = ctx.loadAccount()
 			if err != nil {
 				return nil, err
 			}
-			return New(host, providerName, token, caDirURL, cache)
+			err = opts.Cache.Set(nil)
+			if err != nil {
+				return nil, err
+			}
+			return New(opts)
 		}
 	} else {
 		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -80,27 +172,72 @@ func New(host, providerName, token, caDirURL string, cache Cache) (*Context, err
 		ctx.key = key
 	}
 
+	err = ctx.loadAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.challenge != LocalCA {
+		return ctx, nil
+	}
 	return ctx, ctx.Update()
 }
 
-// Update ...
+// Options returns the options the context is created with
+func (ctx *Context) Options() Options {
+	return ctx.opts
+}
+
+// Update obtains the certificate if there's none, or renews it if it's past the RenewAt.
+// It's safe to call concurrently, check NextAttempt for when to call it again.
 func (ctx *Context) Update() error {
-	if ctx.cert == nil {
-		return ctx.obtain()
-	} else if time.Since(ctx.lastObtain) > month {
-		return ctx.renew()
+	ctx.updateLock.Lock()
+	defer ctx.updateLock.Unlock()
+
+	renewAt, err := ctx.RenewAt()
+	if err == ErrNoCert {
+		err = ctx.obtain()
+	} else if !time.Now().Before(renewAt) {
+		err = ctx.renew()
+	} else {
+		ctx.lock.Lock()
+		ctx.schedule()
+		ctx.lock.Unlock()
+		return nil
 	}
-	return nil
+
+	ctx.record(err)
+	return err
 }
 
-// Cert ...
+// Cert returns nil if the certificate is not obtained yet
 func (ctx *Context) Cert() *tls.Certificate {
+	if ctx == nil {
+		return nil
+	}
+
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+
 	return ctx.cert
 }
 
+// NotAfter returns when the certificate expires
+func (ctx *Context) NotAfter() (time.Time, error) {
+	cert := ctx.Cert()
+	if cert == nil {
+		return time.Time{}, ErrNoCert
+	}
+	return cert.Leaf.NotAfter, nil
+}
+
 func (ctx *Context) obtain() error {
+	if ctx.challenge == LocalCA {
+		return ctx.issue()
+	}
+
 	request := certificate.ObtainRequest{
-		Domains: []string{"*." + ctx.host, ctx.host},
+		Domains: ctx.domains,
 		Bundle:  true,
 	}
 	client, err := ctx.client()
@@ -112,6 +249,7 @@ func (ctx *Context) obtain() error {
 	if err != nil {
 		return err
 	}
+	certificates.Certificate = trimChain(certificates.Certificate, ctx.account.TrimChain)
 	ctx.legoCert = certificates
 	ctx.lastObtain = time.Now()
 
@@ -126,6 +264,10 @@ func (ctx *Context) obtain() error {
 }
 
 func (ctx *Context) renew() error {
+	if ctx.challenge == LocalCA {
+		return ctx.issue()
+	}
+
 	client, err := ctx.client()
 	if err != nil {
 		return err
@@ -135,6 +277,7 @@ func (ctx *Context) renew() error {
 	if err != nil {
 		return err
 	}
+	certificates.Certificate = trimChain(certificates.Certificate, ctx.account.TrimChain)
 	ctx.legoCert = certificates
 	ctx.lastObtain = time.Now()
 
@@ -153,34 +296,42 @@ func (ctx *Context) updateCert() error {
 	if err != nil {
 		return err
 	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+
 	ctx.cert = &cert
 	return nil
 }
 
 func (ctx *Context) client() (*lego.Client, error) {
-	config := lego.NewConfig(&user{key: ctx.key})
+	err := ctx.prepareAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	config := lego.NewConfig(&user{email: ctx.account.Email, key: ctx.key, registration: ctx.registration})
 
 	if ctx.caDirURL != "" {
 		config.CADirURL = ctx.caDirURL
 	}
-	config.Certificate.KeyType = certcrypto.RSA2048
+	config.Certificate.KeyType = ctx.keyType
 
 	client, err := lego.NewClient(config)
 	if err != nil {
 		return nil, err
 	}
 
-	provider, err := ctx.getProvider()
-	if err != nil {
-		return nil, err
-	}
-
-	err = client.Challenge.SetDNS01Provider(provider)
+	err = ctx.setProvider(client)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	err = ctx.register(client)
 	if err != nil {
 		return nil, err
 	}
@@ -188,23 +339,28 @@ func (ctx *Context) client() (*lego.Client, error) {
 	return client, nil
 }
 
-func (ctx *Context) getProvider() (challenge.Provider, error) {
-	switch ctx.providerName {
-	case "dnspod":
-		conf := dnspod.NewDefaultConfig()
-		conf.LoginToken = ctx.token
-		conf.HTTPClient.Timeout = 30 * time.Second
-		return dnspod.NewDNSProviderConfig(conf)
+func (ctx *Context) setProvider(client *lego.Client) error {
+	switch ctx.challenge {
+	case HTTP01:
+		return client.Challenge.SetHTTP01Provider(ctx.httpSolver)
+	case TLSALPN01:
+		return client.Challenge.SetTLSALPN01Provider(ctx.tlsSolver)
 	default:
-		panic("provider not supported: " + ctx.providerName)
+		return client.Challenge.SetDNS01Provider(ctx.provider)
 	}
 }
 
 type cacheData struct {
 	Host              string
+	Challenge         string
+	Domains           []string
 	CaDirURL          string
 	LastObtain        time.Time
 	Key               []byte
+	KeyType           certcrypto.KeyType
+	Registration      *registration.Resource
+	RegisteredEmail   string
+	RegisteredKID     string
 	Cert              certificate.Resource
 	PrivateKey        []byte
 	Certificate       []byte
@@ -216,9 +372,15 @@ func (ctx *Context) marshal() []byte {
 	key, _ := x509.MarshalECPrivateKey(ctx.key)
 	data, _ := json.Marshal(cacheData{
 		Host:              ctx.host,
+		Challenge:         ctx.challenge,
+		Domains:           ctx.domains,
 		CaDirURL:          ctx.caDirURL,
 		LastObtain:        ctx.lastObtain,
 		Key:               key,
+		KeyType:           ctx.keyType,
+		Registration:      ctx.registration,
+		RegisteredEmail:   ctx.registeredEmail,
+		RegisteredKID:     ctx.registeredKID,
 		Cert:              *ctx.legoCert,
 		PrivateKey:        ctx.legoCert.PrivateKey,
 		Certificate:       ctx.legoCert.Certificate,
@@ -228,22 +390,29 @@ func (ctx *Context) marshal() []byte {
 	return data
 }
 
-func (ctx *Context) unmarshal(data []byte) error {
+// unmarshal returns the challenge the cached certificate is obtained with
+func (ctx *Context) unmarshal(data []byte) (string, error) {
 	var cache cacheData
 	err := json.Unmarshal(data, &cache)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	key, err := x509.ParseECPrivateKey(cache.Key)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	ctx.host = cache.Host
+	if len(cache.Domains) > 0 {
+		ctx.domains = cache.Domains
+	}
 	ctx.caDirURL = cache.CaDirURL
 	ctx.lastObtain = cache.LastObtain
 	ctx.key = key
+	ctx.registration = cache.Registration
+	ctx.registeredEmail = cache.RegisteredEmail
+	ctx.registeredKID = cache.RegisteredKID
 	ctx.legoCert = &cache.Cert
 	ctx.legoCert.PrivateKey = cache.PrivateKey
 	ctx.legoCert.Certificate = cache.Certificate
@@ -252,22 +421,19 @@ func (ctx *Context) unmarshal(data []byte) error {
 
 	err = ctx.updateCert()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
-}
-
-type user struct {
-	key crypto.PrivateKey
-}
+	// obtain a new one with the current key type
+	if ctx.challenge != LocalCA && cache.KeyType != "" && cache.KeyType != ctx.keyType {
+		ctx.lock.Lock()
+		ctx.cert = nil
+		ctx.lock.Unlock()
+	}
 
-func (u *user) GetEmail() string {
-	return "you@yours.com"
-}
-func (u user) GetRegistration() *registration.Resource {
-	return nil
-}
-func (u *user) GetPrivateKey() crypto.PrivateKey {
-	return u.key
+	// the caches before the challenge is stored are all from the dns-01
+	if cache.Challenge == "" {
+		return DNS01, nil
+	}
+	return cache.Challenge, nil
 }
@@ -0,0 +1,314 @@
+package cert
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsroute53 "github.com/aws/aws-sdk-go/service/route53"
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/providers/dns/cloudflare"
+	"github.com/go-acme/lego/v3/providers/dns/desec"
+	"github.com/go-acme/lego/v3/providers/dns/digitalocean"
+	"github.com/go-acme/lego/v3/providers/dns/dnspod"
+	"github.com/go-acme/lego/v3/providers/dns/duckdns"
+	"github.com/go-acme/lego/v3/providers/dns/exec"
+	"github.com/go-acme/lego/v3/providers/dns/gandiv5"
+	"github.com/go-acme/lego/v3/providers/dns/godaddy"
+	"github.com/go-acme/lego/v3/providers/dns/hetzner"
+	"github.com/go-acme/lego/v3/providers/dns/httpreq"
+	"github.com/go-acme/lego/v3/providers/dns/namecheap"
+	"github.com/go-acme/lego/v3/providers/dns/netlify"
+	"github.com/go-acme/lego/v3/providers/dns/pdns"
+	"github.com/go-acme/lego/v3/providers/dns/rfc2136"
+	"github.com/go-acme/lego/v3/providers/dns/route53"
+)
+
+// Provider creates a DNS-01 provider from the config
+type Provider func(config map[string]string) (challenge.Provider, error)
+
+var providers = map[string]Provider{}
+var providersLock sync.Mutex
+
+func init() {
+	Register("dnspod", func(config map[string]string) (challenge.Provider, error) {
+		conf := dnspod.NewDefaultConfig()
+		conf.HTTPClient.Timeout = 30 * time.Second
+		err := Fields(config, map[string]*string{"token": &conf.LoginToken, "DNSPOD_API_KEY": &conf.LoginToken})
+		if err != nil {
+			return nil, err
+		}
+		return dnspod.NewDNSProviderConfig(conf)
+	})
+
+	Register("cloudflare", func(config map[string]string) (challenge.Provider, error) {
+		conf := cloudflare.NewDefaultConfig()
+		err := Fields(config, map[string]*string{
+			"CLOUDFLARE_EMAIL":          &conf.AuthEmail,
+			"CF_API_EMAIL":              &conf.AuthEmail,
+			"CLOUDFLARE_API_KEY":        &conf.AuthKey,
+			"CF_API_KEY":                &conf.AuthKey,
+			"CLOUDFLARE_DNS_API_TOKEN":  &conf.AuthToken,
+			"CF_DNS_API_TOKEN":          &conf.AuthToken,
+			"CLOUDFLARE_ZONE_API_TOKEN": &conf.ZoneToken,
+			"CF_ZONE_API_TOKEN":         &conf.ZoneToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if conf.ZoneToken == "" {
+			conf.ZoneToken = conf.AuthToken
+		}
+		return cloudflare.NewDNSProviderConfig(conf)
+	})
+
+	Register("route53", func(config map[string]string) (challenge.Provider, error) {
+		conf := route53.NewDefaultConfig()
+		var id, secret, token, region string
+		err := Fields(config, map[string]*string{
+			"AWS_ACCESS_KEY_ID":     &id,
+			"AWS_SECRET_ACCESS_KEY": &secret,
+			"AWS_SESSION_TOKEN":     &token,
+			"AWS_REGION":            &region,
+			"AWS_HOSTED_ZONE_ID":    &conf.HostedZoneID,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// without the keys the sdk finds the credentials itself, such as the shared file or the EC2 IAM role
+		if id != "" {
+			awsConf := aws.NewConfig().
+				WithCredentials(credentials.NewStaticCredentials(id, secret, token)).
+				WithMaxRetries(conf.MaxRetries)
+			if region != "" {
+				awsConf = awsConf.WithRegion(region)
+			}
+			sess, err := session.NewSession(awsConf)
+			if err != nil {
+				return nil, err
+			}
+			conf.Client = awsroute53.New(sess)
+		}
+		return route53.NewDNSProviderConfig(conf)
+	})
+
+	Register("desec", func(config map[string]string) (challenge.Provider, error) {
+		conf := desec.NewDefaultConfig()
+		if err := Fields(config, map[string]*string{desec.EnvToken: &conf.Token}); err != nil {
+			return nil, err
+		}
+		return desec.NewDNSProviderConfig(conf)
+	})
+
+	Register("digitalocean", func(config map[string]string) (challenge.Provider, error) {
+		conf := digitalocean.NewDefaultConfig()
+		if err := Fields(config, map[string]*string{digitalocean.EnvAuthToken: &conf.AuthToken}); err != nil {
+			return nil, err
+		}
+		return digitalocean.NewDNSProviderConfig(conf)
+	})
+
+	Register("duckdns", func(config map[string]string) (challenge.Provider, error) {
+		conf := duckdns.NewDefaultConfig()
+		if err := Fields(config, map[string]*string{duckdns.EnvToken: &conf.Token}); err != nil {
+			return nil, err
+		}
+		return duckdns.NewDNSProviderConfig(conf)
+	})
+
+	Register("exec", func(config map[string]string) (challenge.Provider, error) {
+		conf := exec.NewDefaultConfig()
+		err := Fields(config, map[string]*string{exec.EnvPath: &conf.Program, exec.EnvMode: &conf.Mode})
+		if err != nil {
+			return nil, err
+		}
+		return exec.NewDNSProviderConfig(conf)
+	})
+
+	Register("gandiv5", func(config map[string]string) (challenge.Provider, error) {
+		conf := gandiv5.NewDefaultConfig()
+		if err := Fields(config, map[string]*string{gandiv5.EnvAPIKey: &conf.APIKey}); err != nil {
+			return nil, err
+		}
+		return gandiv5.NewDNSProviderConfig(conf)
+	})
+
+	Register("godaddy", func(config map[string]string) (challenge.Provider, error) {
+		conf := godaddy.NewDefaultConfig()
+		err := Fields(config, map[string]*string{godaddy.EnvAPIKey: &conf.APIKey, godaddy.EnvAPISecret: &conf.APISecret})
+		if err != nil {
+			return nil, err
+		}
+		return godaddy.NewDNSProviderConfig(conf)
+	})
+
+	Register("hetzner", func(config map[string]string) (challenge.Provider, error) {
+		conf := hetzner.NewDefaultConfig()
+		if err := Fields(config, map[string]*string{hetzner.EnvAPIKey: &conf.APIKey}); err != nil {
+			return nil, err
+		}
+		return hetzner.NewDNSProviderConfig(conf)
+	})
+
+	Register("httpreq", func(config map[string]string) (challenge.Provider, error) {
+		conf := httpreq.NewDefaultConfig()
+		var endpoint string
+		err := Fields(config, map[string]*string{
+			httpreq.EnvEndpoint: &endpoint,
+			httpreq.EnvMode:     &conf.Mode,
+			httpreq.EnvUsername: &conf.Username,
+			httpreq.EnvPassword: &conf.Password,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if endpoint != "" {
+			conf.Endpoint, err = url.Parse(endpoint)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return httpreq.NewDNSProviderConfig(conf)
+	})
+
+	Register("namecheap", func(config map[string]string) (challenge.Provider, error) {
+		conf := namecheap.NewDefaultConfig()
+		err := Fields(config, map[string]*string{namecheap.EnvAPIUser: &conf.APIUser, namecheap.EnvAPIKey: &conf.APIKey})
+		if err != nil {
+			return nil, err
+		}
+		return namecheap.NewDNSProviderConfig(conf)
+	})
+
+	Register("netlify", func(config map[string]string) (challenge.Provider, error) {
+		conf := netlify.NewDefaultConfig()
+		if err := Fields(config, map[string]*string{netlify.EnvToken: &conf.Token}); err != nil {
+			return nil, err
+		}
+		return netlify.NewDNSProviderConfig(conf)
+	})
+
+	Register("pdns", func(config map[string]string) (challenge.Provider, error) {
+		conf := pdns.NewDefaultConfig()
+		var host string
+		err := Fields(config, map[string]*string{pdns.EnvAPIKey: &conf.APIKey, pdns.EnvAPIURL: &host})
+		if err != nil {
+			return nil, err
+		}
+		if host != "" {
+			conf.Host, err = url.Parse(host)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return pdns.NewDNSProviderConfig(conf)
+	})
+
+	Register("rfc2136", func(config map[string]string) (challenge.Provider, error) {
+		conf := rfc2136.NewDefaultConfig()
+		err := Fields(config, map[string]*string{
+			rfc2136.EnvNameserver:    &conf.Nameserver,
+			rfc2136.EnvTSIGKey:       &conf.TSIGKey,
+			rfc2136.EnvTSIGSecret:    &conf.TSIGSecret,
+			rfc2136.EnvTSIGAlgorithm: &conf.TSIGAlgorithm,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return rfc2136.NewDNSProviderConfig(conf)
+	})
+}
+
+// Register a DNS-01 provider with the name, use it to add the lego providers that are not built in:
+//
+//	cert.Register("linode", func(config map[string]string) (challenge.Provider, error) {
+//	    conf := linode.NewDefaultConfig()
+//	    err := cert.Fields(config, map[string]*string{linode.EnvAPIKey: &conf.APIKey})
+//	    if err != nil {
+//	        return nil, err
+//	    }
+//	    return linode.NewDNSProviderConfig(conf)
+//	})
+func Register(name string, p Provider) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+
+	providers[name] = p
+}
+
+// Providers returns the sorted names of the registered providers
+func Providers() []string {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+
+	list := []string{}
+	for name := range providers {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// NewProvider creates the provider with the name
+func NewProvider(name string, config map[string]string) (challenge.Provider, error) {
+	providersLock.Lock()
+	p, has := providers[name]
+	providersLock.Unlock()
+
+	if !has {
+		return nil, fmt.Errorf("dns provider not supported: %s, the supported ones are: %s",
+			name, strings.Join(Providers(), ", "))
+	}
+
+	provider, err := p(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dns provider %s: %w", name, err)
+	}
+	return provider, nil
+}
+
+// Fields copies the config to the fields of a lego provider config, the keys are the env var names documented
+// by lego, such as "RFC2136_NAMESERVER". Unlike the NewDNSProvider of lego, it doesn't touch the env vars of the
+// process, the unknown keys are reported.
+func Fields(config map[string]string, fields map[string]*string) error {
+	for k, v := range config {
+		field, has := fields[k]
+		if !has {
+			list := []string{}
+			for name := range fields {
+				list = append(list, name)
+			}
+			sort.Strings(list)
+			return fmt.Errorf("unknown dns config key: %s, the supported ones are: %s", k, strings.Join(list, ", "))
+		}
+		*field = v
+	}
+	return nil
+}
+
+// ParseConfig parses the config of a provider, it's a json object of strings, such as
+// `{"RFC2136_NAMESERVER": "127.0.0.1:53"}`, any other non-empty string will be treated as {"token": s}.
+func ParseConfig(s string) (map[string]string, error) {
+	config := map[string]string{}
+	if s == "" {
+		return config, nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(s), "{") {
+		config["token"] = s
+		return config, nil
+	}
+
+	err := json.Unmarshal([]byte(s), &config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns config: %w", err)
+	}
+	return config, nil
+}
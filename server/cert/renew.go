@@ -0,0 +1,139 @@
+package cert
+
+import (
+	"errors"
+	"time"
+)
+
+// the delay of the first retry after a failed update, it doubles on each failure until retryMax
+const retryMin = time.Minute
+const retryMax = 6 * time.Hour
+
+// checkInterval is the max time between two updates, so that a cert changed outside will be noticed
+const checkInterval = 24 * time.Hour
+
+// ErrNoCert ...
+var ErrNoCert = errors.New("the certificate is not obtained yet")
+
+// Status of the certificate and its renewal
+type Status struct {
+	Challenge string
+	Domains   []string
+
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// RenewAt when the certificate will be renewed, it's when 1/3 of its lifetime remains
+	RenewAt time.Time
+
+	LastAttempt time.Time
+	NextAttempt time.Time
+
+	// LastError the error of the last attempt, empty if it succeeded
+	LastError string
+
+	// Failures the number of the consecutive failed attempts
+	Failures int
+}
+
+// RenewAt returns when the certificate should be renewed. ACME Renewal Information (ARI) is not supported
+// by the acme client yet, so it's derived from the validity period of the certificate, like most of the acme clients do.
+func (ctx *Context) RenewAt() (time.Time, error) {
+	cert := ctx.Cert()
+	if cert == nil {
+		return time.Time{}, ErrNoCert
+	}
+	return renewAt(cert.Leaf.NotBefore, cert.Leaf.NotAfter), nil
+}
+
+func renewAt(notBefore, notAfter time.Time) time.Time {
+	return notAfter.Add(-notAfter.Sub(notBefore) / 3)
+}
+
+// NextAttempt returns the duration until Update should be called again
+func (ctx *Context) NextAttempt() time.Duration {
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+
+	return time.Until(ctx.nextAttempt)
+}
+
+// Status returns the status of the certificate
+func (ctx *Context) Status() Status {
+	s := Status{
+		Challenge: ctx.challenge,
+		Domains:   ctx.domains,
+	}
+
+	if cert := ctx.Cert(); cert != nil {
+		s.NotBefore = cert.Leaf.NotBefore
+		s.NotAfter = cert.Leaf.NotAfter
+		s.RenewAt = renewAt(s.NotBefore, s.NotAfter)
+	}
+
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+
+	s.LastAttempt = ctx.lastAttempt
+	s.NextAttempt = ctx.nextAttempt
+	s.Failures = ctx.failures
+	if ctx.lastError != nil {
+		s.LastError = ctx.lastError.Error()
+	}
+	return s
+}
+
+// Fail records a failed attempt that doesn't reach Update, such as a check before it,
+// so that the next attempt backs off the same way
+func (ctx *Context) Fail(err error) {
+	ctx.record(err)
+}
+
+// record the result of an attempt, then schedule the next one
+func (ctx *Context) record(err error) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+
+	ctx.lastAttempt = time.Now()
+	ctx.lastError = err
+	if err != nil {
+		ctx.failures++
+	} else {
+		ctx.failures = 0
+	}
+	ctx.schedule()
+}
+
+// schedule the next attempt, retry with backoff if the last attempt failed,
+// or wait until the RenewAt but no longer than the checkInterval. The lock must be held.
+func (ctx *Context) schedule() {
+	now := time.Now()
+
+	if ctx.failures > 0 {
+		ctx.nextAttempt = now.Add(backoff(ctx.failures))
+		return
+	}
+
+	wait := checkInterval
+	if ctx.cert != nil {
+		if d := renewAt(ctx.cert.Leaf.NotBefore, ctx.cert.Leaf.NotAfter).Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < retryMin {
+		wait = retryMin
+	}
+	ctx.nextAttempt = now.Add(wait)
+}
+
+// backoff returns the delay before the next retry after the failures
+func backoff(failures int) time.Duration {
+	d := retryMin
+	for i := 1; i < failures && d < retryMax; i++ {
+		d *= 2
+	}
+	if d > retryMax {
+		return retryMax
+	}
+	return d
+}
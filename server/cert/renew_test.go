@@ -0,0 +1,71 @@
+package cert
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type errCache struct{}
+
+func (c *errCache) Get() ([]byte, error) { return nil, nil }
+func (c *errCache) Set([]byte) error     { return errors.New("cache err") }
+
+func TestRenewAt(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, now.Add(60*24*time.Hour), renewAt(now, now.Add(90*24*time.Hour)))
+
+	assert.Equal(t, time.Minute, backoff(1))
+	assert.Equal(t, 4*time.Minute, backoff(3))
+	assert.Equal(t, retryMax, backoff(100))
+}
+
+func TestRenew(t *testing.T) {
+	ctx, err := New(Options{Host: "digto.org", Challenge: LocalCA, Cache: &memCache{}, CACache: &memCache{}})
+	assert.Nil(t, err)
+
+	s := ctx.Status()
+	assert.Equal(t, LocalCA, s.Challenge)
+	assert.WithinDuration(t, time.Now().Add(localCertLifetime), s.NotAfter, time.Hour*2)
+	assert.Equal(t, s.NotAfter.Add(-s.NotAfter.Sub(s.NotBefore)/3), s.RenewAt)
+	assert.Empty(t, s.LastError)
+	assert.WithinDuration(t, time.Now().Add(checkInterval), s.NextAttempt, time.Minute)
+
+	// not the time to renew yet
+	old := ctx.Cert()
+	assert.Nil(t, ctx.Update())
+	assert.Equal(t, old, ctx.Cert())
+
+	// the cert is swapped while it's being read
+	leaf := *old.Leaf
+	leaf.NotBefore = time.Now().Add(-80 * 24 * time.Hour)
+	leaf.NotAfter = time.Now().Add(10 * 24 * time.Hour)
+	old.Leaf = &leaf
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			assert.NotNil(t, ctx.Cert())
+		}
+	}()
+	assert.Nil(t, ctx.Update())
+	wg.Wait()
+	assert.NotEqual(t, old, ctx.Cert())
+
+	// failed attempts are retried with backoff
+	ctx.cache = &errCache{}
+	for i := 0; i < 2; i++ {
+		ctx.Cert().Leaf.NotAfter = time.Now()
+		assert.EqualError(t, ctx.Update(), "cache err")
+	}
+
+	s = ctx.Status()
+	assert.Equal(t, "cache err", s.LastError)
+	assert.Equal(t, 2, s.Failures)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), s.NextAttempt, time.Second)
+}
@@ -0,0 +1,109 @@
+package cert
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v3/challenge/http01"
+	"github.com/go-acme/lego/v3/challenge/tlsalpn01"
+)
+
+// the challenge types
+const (
+	DNS01     = "dns-01"
+	HTTP01    = "http-01"
+	TLSALPN01 = "tls-alpn-01"
+
+	// LocalCA issues the certificate with a local CA instead of the ACME, for the environments without the internet
+	LocalCA = "local-ca"
+)
+
+// httpSolver keeps the HTTP-01 tokens for the http server of digto to respond, check Context.HTTPChallenge
+type httpSolver struct {
+	lock   sync.Mutex
+	tokens map[string]string
+}
+
+func (s *httpSolver) Present(domain, token, keyAuth string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tokens[token] = keyAuth
+	return nil
+}
+
+func (s *httpSolver) CleanUp(domain, token, keyAuth string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.tokens, token)
+	return nil
+}
+
+func (s *httpSolver) get(token string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keyAuth, has := s.tokens[token]
+	return keyAuth, has
+}
+
+// tlsSolver keeps the TLS-ALPN-01 certificates for the https server of digto to respond, check Context.TLSALPNCert
+type tlsSolver struct {
+	lock  sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func (s *tlsSolver) Present(domain, token, keyAuth string) error {
+	cert, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.certs[domain] = cert
+	return nil
+}
+
+func (s *tlsSolver) CleanUp(domain, token, keyAuth string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.certs, domain)
+	return nil
+}
+
+func (s *tlsSolver) get(domain string) *tls.Certificate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.certs[domain]
+}
+
+// HTTPChallenge responds the HTTP-01 challenge request, returns false if it's not one
+func (ctx *Context) HTTPChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if ctx == nil || !strings.HasPrefix(r.URL.Path, http01.ChallengePath("")) {
+		return false
+	}
+
+	keyAuth, has := ctx.httpSolver.get(strings.TrimPrefix(r.URL.Path, http01.ChallengePath("")))
+	if !has {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(keyAuth))
+	return true
+}
+
+// TLSALPNCert returns the TLS-ALPN-01 challenge certificate if the client hello is a challenge, or nil
+func (ctx *Context) TLSALPNCert(hello *tls.ClientHelloInfo) *tls.Certificate {
+	if ctx == nil || len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != tlsalpn01.ACMETLS1Protocol {
+		return nil
+	}
+	return ctx.tlsSolver.get(hello.ServerName)
+}
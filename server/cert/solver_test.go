@@ -0,0 +1,48 @@
+package cert
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-acme/lego/v3/challenge/tlsalpn01"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPChallenge(t *testing.T) {
+	ctx, err := New(Options{Host: "digto.org", Challenge: HTTP01, Subdomains: []string{"a"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"digto.org", "a.digto.org"}, ctx.domains)
+
+	assert.Nil(t, ctx.httpSolver.Present("a.digto.org", "token", "auth"))
+
+	res := httptest.NewRecorder()
+	assert.True(t, ctx.HTTPChallenge(res, httptest.NewRequest("GET", "http://a.digto.org/.well-known/acme-challenge/token", nil)))
+	assert.Equal(t, "auth", res.Body.String())
+
+	res = httptest.NewRecorder()
+	assert.False(t, ctx.HTTPChallenge(res, httptest.NewRequest("GET", "http://a.digto.org/.well-known/acme-challenge/other", nil)))
+	assert.False(t, ctx.HTTPChallenge(res, httptest.NewRequest("GET", "http://a.digto.org/path", nil)))
+
+	assert.Nil(t, ctx.httpSolver.CleanUp("a.digto.org", "token", "auth"))
+	assert.False(t, ctx.HTTPChallenge(res, httptest.NewRequest("GET", "http://a.digto.org/.well-known/acme-challenge/token", nil)))
+
+	var nilCtx *Context
+	assert.False(t, nilCtx.HTTPChallenge(res, httptest.NewRequest("GET", "http://a.digto.org/.well-known/acme-challenge/token", nil)))
+}
+
+func TestTLSALPNChallenge(t *testing.T) {
+	ctx, err := New(Options{Host: "digto.org", Challenge: TLSALPN01})
+	assert.Nil(t, err)
+
+	assert.Nil(t, ctx.tlsSolver.Present("digto.org", "token", "auth"))
+
+	hello := &tls.ClientHelloInfo{ServerName: "digto.org", SupportedProtos: []string{tlsalpn01.ACMETLS1Protocol}}
+	assert.NotNil(t, ctx.TLSALPNCert(hello))
+
+	hello.SupportedProtos = []string{"h2", "http/1.1"}
+	assert.Nil(t, ctx.TLSALPNCert(hello))
+
+	_, err = New(Options{Host: "digto.org", Challenge: "nope"})
+	assert.EqualError(t, err, "challenge not supported: nope")
+}
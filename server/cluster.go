@@ -0,0 +1,281 @@
+package server
+
+import (
+	"crypto/subtle"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ysmood/digto/server/cluster"
+	"github.com/ysmood/kit"
+)
+
+// clusterProxy hands the public requests over to the nodes that have waiting consumers of the subdomain,
+// and the responses of the consumers over to the nodes that hold the public requests.
+// It's disabled if the coordinator is nil.
+type clusterProxy struct {
+	node        cluster.Node
+	secret      string
+	coordinator cluster.Coordinator
+
+	// owner is true if this node keeps the coordinator, the api keys and the reservations
+	owner bool
+
+	lock sync.Mutex
+	// waiting subdomain -> count of the consumers polling this node
+	waiting map[string]int
+	// reported subdomain -> when its last consumer left, zero if it still has consumers.
+	// It's kept in the heartbeats until the next tick, so that the polls won't report it again and again.
+	reported map[string]time.Time
+
+	// beatLock keeps the heartbeats in order
+	beatLock sync.Mutex
+}
+
+func newClusterProxy(node cluster.Node, secret string, coordinator cluster.Coordinator) *clusterProxy {
+	return &clusterProxy{
+		node:        node,
+		secret:      secret,
+		coordinator: coordinator,
+		waiting:     map[string]int{},
+		reported:    map[string]time.Time{},
+	}
+}
+
+// clusterUnsupported are the actions whose state is kept by the node that handles the api request,
+// the public requests that arrive at the other nodes won't see it
+var clusterUnsupported = map[string]bool{
+	"queue":  true,
+	"domain": true,
+	"mux":    true,
+}
+
+// forwardedHeader marks the public request is already handed over by another node, the value is the secret
+const forwardedHeader = "Digto-Forwarded"
+
+func (cp *clusterProxy) enabled() bool {
+	return cp.coordinator != nil
+}
+
+// newID of a public request, the node name is the prefix so that any node can route the response to it
+func (cp *clusterProxy) newID() string {
+	if !cp.enabled() {
+		return randString()
+	}
+	return cp.node.Name + "." + randString()
+}
+
+// join marks a consumer of the subdomain is polling this node, the returned func undoes it.
+// Only a subdomain that isn't reported yet triggers a heartbeat, the others wait for the next tick.
+func (cp *clusterProxy) join(subdomain string) func() {
+	if !cp.enabled() {
+		return func() {}
+	}
+
+	cp.lock.Lock()
+	cp.waiting[subdomain]++
+	_, reported := cp.reported[subdomain]
+	cp.reported[subdomain] = time.Time{}
+	cp.lock.Unlock()
+
+	if !reported {
+		cp.heartbeat()
+	}
+
+	return func() {
+		cp.lock.Lock()
+		defer cp.lock.Unlock()
+
+		cp.waiting[subdomain]--
+		if cp.waiting[subdomain] == 0 {
+			delete(cp.waiting, subdomain)
+			cp.reported[subdomain] = time.Now()
+		}
+	}
+}
+
+// heartbeat reports the subdomains of the waiting consumers to the coordinator
+func (cp *clusterProxy) heartbeat() {
+	cp.beatLock.Lock()
+	defer cp.beatLock.Unlock()
+
+	cp.lock.Lock()
+	list := []string{}
+	for subdomain, leftAt := range cp.reported {
+		if !leftAt.IsZero() && time.Since(leftAt) > cluster.HeartbeatInterval {
+			delete(cp.reported, subdomain)
+			continue
+		}
+		list = append(list, subdomain)
+	}
+	cp.lock.Unlock()
+
+	err := cp.coordinator.Heartbeat(cp.node, list)
+	if err != nil {
+		kit.Err("[digto] cluster heartbeat", err)
+	}
+}
+
+// beat sends the heartbeats until the done is closed
+func (cp *clusterProxy) beat(done chan struct{}) {
+	if !cp.enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(cluster.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		cp.heartbeat()
+		select {
+		case <-ticker.C:
+		case <-done:
+			// stop receiving the public requests of the other nodes
+			err := cp.coordinator.Heartbeat(cp.node, nil)
+			if err != nil {
+				kit.Err("[digto] cluster heartbeat", err)
+			}
+			return
+		}
+	}
+}
+
+// auth checks the api request on the owner node, it returns false if this node is the owner.
+// Call the done when the request ends to release the lease on the owner node.
+func (cp *clusterProxy) auth(subdomain, key, token string) (handled, reserved bool, done func(), err error) {
+	if !cp.enabled() || cp.owner {
+		return false, false, nil, nil
+	}
+	reserved, lease, err := cp.coordinator.Auth(subdomain, key, token)
+	if err != nil {
+		return true, false, nil, err
+	}
+	return true, reserved, func() {
+		err := cp.coordinator.Release(lease)
+		if err != nil {
+			kit.Err("[digto] cluster release", err)
+		}
+	}, nil
+}
+
+// toOwner forwards the request to the owner node, it returns false if this node is the owner
+func (cp *clusterProxy) toOwner(ctx kit.GinContext) bool {
+	if !cp.enabled() || cp.owner {
+		return false
+	}
+
+	node, err := cp.coordinator.Owner()
+	if err != nil {
+		apiError(ctx, err.Error())
+		return true
+	}
+	if node == nil {
+		apiError(ctx, "the owner node of the cluster is unknown")
+		return true
+	}
+
+	cp.proxyTo(*node, ctx)
+	return true
+}
+
+// forwarded returns true if the public request is handed over by another node, the header is removed
+// so that the consumer won't see the secret
+func (cp *clusterProxy) forwarded(ctx kit.GinContext) bool {
+	v := ctx.GetHeader(forwardedHeader)
+	if v == "" || !cp.enabled() {
+		return false
+	}
+	ctx.Request.Header.Del(forwardedHeader)
+	return subtle.ConstantTimeCompare([]byte(v), []byte(cp.secret)) == 1
+}
+
+// pick a node that has waiting consumers of the subdomain, nil if this node has one or no node has one
+func (cp *clusterProxy) pick(subdomain string) *cluster.Node {
+	if !cp.enabled() {
+		return nil
+	}
+
+	cp.lock.Lock()
+	local := cp.waiting[subdomain] > 0
+	cp.lock.Unlock()
+	if local {
+		return nil
+	}
+
+	nodes, err := cp.coordinator.Nodes(subdomain)
+	if err != nil {
+		kit.Err("[digto] cluster nodes", err)
+		return nil
+	}
+
+	for _, node := range nodes {
+		if node.Name == cp.node.Name {
+			return nil
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	return &nodes[rand.Intn(len(nodes))]
+}
+
+// recheck ticks while a public request waits, so that it can be handed over to a consumer that starts
+// polling another node, the channel is nil if the cluster is disabled
+func (cp *clusterProxy) recheck() (<-chan time.Time, func()) {
+	if !cp.enabled() {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(time.Second)
+	return ticker.C, ticker.Stop
+}
+
+// forwardRes returns true if the response belongs to a public request held by another node
+func (cp *clusterProxy) forwardRes(id string, ctx kit.GinContext) bool {
+	if !cp.enabled() {
+		return false
+	}
+
+	name := strings.SplitN(id, ".", 2)[0]
+	if name == id || name == cp.node.Name {
+		return false
+	}
+
+	node, err := cp.coordinator.Node(name)
+	if err != nil {
+		apiError(ctx, err.Error())
+		return true
+	}
+	if node == nil {
+		apiError(ctx, "unknown cluster node: "+name)
+		return true
+	}
+
+	cp.proxyTo(*node, ctx)
+	return true
+}
+
+// forward the public request to the node
+func (cp *clusterProxy) forward(node cluster.Node, ctx kit.GinContext) {
+	ctx.Request.Header.Set(forwardedHeader, cp.secret)
+	cp.proxyTo(node, ctx)
+}
+
+func (cp *clusterProxy) proxyTo(node cluster.Node, ctx kit.GinContext) {
+	u, err := url.Parse(node.URL)
+	if err != nil {
+		apiError(ctx, err.Error())
+		return
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(u)
+	rp.FlushInterval = -1
+	rp.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+		w.Header().Set("Digto-Error", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	rp.ServeHTTP(ctx.Writer, ctx.Request)
+}
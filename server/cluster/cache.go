@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+)
+
+// CacheTTL is how long the Cache keeps the nodes
+const CacheTTL = 2 * time.Second
+
+// Cache keeps the results of Nodes, Node and Owner of a remote coordinator for the ttl, so that the public
+// requests and their rechecks won't call the coordinator every time. An unknown node is not cached.
+type Cache struct {
+	Coordinator
+
+	ttl   time.Duration
+	lock  sync.Mutex
+	nodes map[string]cachedNodes
+	node  map[string]cachedNode
+	owner cachedNode
+}
+
+type cachedNodes struct {
+	list []Node
+	at   time.Time
+}
+
+type cachedNode struct {
+	node *Node
+	at   time.Time
+}
+
+var _ Coordinator = &Cache{}
+
+// NewCache wraps the coordinator
+func NewCache(c Coordinator, ttl time.Duration) *Cache {
+	return &Cache{
+		Coordinator: c,
+		ttl:         ttl,
+		nodes:       map[string]cachedNodes{},
+		node:        map[string]cachedNode{},
+	}
+}
+
+// Nodes ...
+func (c *Cache) Nodes(subdomain string) ([]Node, error) {
+	c.lock.Lock()
+	item, has := c.nodes[subdomain]
+	c.lock.Unlock()
+	if has && time.Since(item.at) < c.ttl {
+		return item.list, nil
+	}
+
+	list, err := c.Coordinator.Nodes(subdomain)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for name, item := range c.nodes {
+		if time.Since(item.at) >= c.ttl {
+			delete(c.nodes, name)
+		}
+	}
+	c.nodes[subdomain] = cachedNodes{list, time.Now()}
+	return list, nil
+}
+
+// Node ...
+func (c *Cache) Node(name string) (*Node, error) {
+	c.lock.Lock()
+	item, has := c.node[name]
+	c.lock.Unlock()
+	if has && time.Since(item.at) < c.ttl {
+		return item.node, nil
+	}
+
+	node, err := c.Coordinator.Node(name)
+	if err != nil || node == nil {
+		return node, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.node[name] = cachedNode{node, time.Now()}
+	return node, nil
+}
+
+// Owner ...
+func (c *Cache) Owner() (*Node, error) {
+	c.lock.Lock()
+	item := c.owner
+	c.lock.Unlock()
+	if item.node != nil && time.Since(item.at) < c.ttl {
+		return item.node, nil
+	}
+
+	node, err := c.Coordinator.Owner()
+	if err != nil || node == nil {
+		return node, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.owner = cachedNode{node, time.Now()}
+	return node, nil
+}
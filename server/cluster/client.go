@@ -0,0 +1,172 @@
+package cluster
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ysmood/kit"
+)
+
+// SecretHeader authenticates the requests between the nodes
+const SecretHeader = "Digto-Cluster-Secret"
+
+// Client uses the coordinator of another node via its Handler
+type Client struct {
+	url    string
+	host   string
+	secret string
+	client *http.Client
+}
+
+var _ Coordinator = &Client{}
+
+// NewClient the url is the node that serves the Handler, the host is the api host of the server
+func NewClient(url, host, secret string) *Client {
+	return &Client{
+		url:    strings.TrimRight(url, "/") + "/-/cluster/",
+		host:   host,
+		secret: secret,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type heartbeat struct {
+	Node       Node     `json:"node"`
+	Subdomains []string `json:"subdomains"`
+}
+
+type authReq struct {
+	Subdomain string `json:"subdomain"`
+	Key       string `json:"key"`
+	Token     string `json:"token"`
+}
+
+type authRes struct {
+	Reserved bool   `json:"reserved"`
+	Lease    string `json:"lease"`
+}
+
+// Heartbeat ...
+func (c *Client) Heartbeat(node Node, subdomains []string) error {
+	return c.do(c.req("heartbeat").Post().JSONBody(heartbeat{node, subdomains}), nil)
+}
+
+// Nodes ...
+func (c *Client) Nodes(subdomain string) ([]Node, error) {
+	list := []Node{}
+	err := c.do(c.req("nodes").Query("subdomain", subdomain), &list)
+	return list, err
+}
+
+// Node ...
+func (c *Client) Node(name string) (*Node, error) {
+	var node *Node
+	err := c.do(c.req("node").Query("name", name), &node)
+	return node, err
+}
+
+// Owner ...
+func (c *Client) Owner() (*Node, error) {
+	var node *Node
+	err := c.do(c.req("owner"), &node)
+	return node, err
+}
+
+// Auth ...
+func (c *Client) Auth(subdomain, key, token string) (bool, string, error) {
+	var res authRes
+	err := c.do(c.req("auth").Post().JSONBody(authReq{subdomain, key, token}), &res)
+	return res.Reserved, res.Lease, err
+}
+
+// Release ...
+func (c *Client) Release(lease string) error {
+	return c.do(c.req("release").Post().Query("lease", lease), nil)
+}
+
+func (c *Client) req(action string) *kit.ReqContext {
+	return kit.Req(c.url+action).Client(c.client).Host(c.host).Header(SecretHeader, c.secret)
+}
+
+func (c *Client) do(req *kit.ReqContext, v interface{}) error {
+	res, err := req.Response()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if msg := res.Header.Get("Digto-Error"); msg != "" {
+		return errors.New(msg)
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.New("coordinator responded " + res.Status)
+	}
+	if v == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// Handler serves the coordinator to the Client of the other nodes, the path ends with the action,
+// such as "/-/cluster/join"
+func Handler(coordinator Coordinator, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fail := func(err error) {
+			w.Header().Set("Digto-Error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+		}
+
+		if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(secret)) != 1 {
+			fail(errors.New("invalid " + SecretHeader))
+			return
+		}
+
+		var data interface{}
+		var err error
+
+		switch action := path.Base(r.URL.Path); action {
+		case "heartbeat":
+			var h heartbeat
+			err = json.NewDecoder(r.Body).Decode(&h)
+			if err == nil {
+				err = coordinator.Heartbeat(h.Node, h.Subdomains)
+			}
+		case "auth":
+			var a authReq
+			err = json.NewDecoder(r.Body).Decode(&a)
+			if err == nil {
+				var res authRes
+				res.Reserved, res.Lease, err = coordinator.Auth(a.Subdomain, a.Key, a.Token)
+				data = res
+			}
+		case "release":
+			err = coordinator.Release(r.URL.Query().Get("lease"))
+		case "owner":
+			data, err = coordinator.Owner()
+		case "nodes":
+			data, err = coordinator.Nodes(r.URL.Query().Get("subdomain"))
+		case "node":
+			data, err = coordinator.Node(r.URL.Query().Get("name"))
+		default:
+			err = errors.New("unknown action: " + action)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(data)
+	})
+}
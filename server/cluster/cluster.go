@@ -0,0 +1,197 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ysmood/kit"
+)
+
+// HeartbeatInterval is how often a node reports its waiting consumers to the coordinator
+const HeartbeatInterval = 10 * time.Second
+
+// DefaultTTL is how long the Memory keeps a node after its last heartbeat
+const DefaultTTL = 3 * HeartbeatInterval
+
+// Node is a server instance of the cluster
+type Node struct {
+	// Name is unique in the cluster, it's the prefix of the Digto-ID of the requests handled by the node
+	Name string `json:"name"`
+
+	// URL is the address the other nodes use to reach the node, such as "http://10.0.0.2:80"
+	URL string `json:"url"`
+}
+
+// AuthFunc checks the api key and the reservation token of the subdomain, reserved is true if the subdomain
+// is reserved. The release is called when the api request ends.
+type AuthFunc func(subdomain, key, token string) (reserved bool, release func(), err error)
+
+// Coordinator shares the waiting consumers of the nodes, so that a public request can be handed over to the
+// node that the consumer is polling. It also shares the api keys and the reservations of the owner node.
+type Coordinator interface {
+	// Heartbeat reports the subdomains that have waiting consumers on the node, it replaces the last report.
+	// The node should send it every HeartbeatInterval, or it will be removed.
+	Heartbeat(node Node, subdomains []string) error
+
+	// Nodes returns the nodes that have waiting consumers of the subdomain
+	Nodes(subdomain string) ([]Node, error)
+
+	// Node returns the node of the name, nil if it's unknown or it stops sending heartbeats
+	Node(name string) (*Node, error)
+
+	// Owner returns the node that keeps the coordinator, the api keys and the reservations of the cluster
+	Owner() (*Node, error)
+
+	// Auth checks the api request on the Owner, the lease should be released via Release when the request ends
+	Auth(subdomain, key, token string) (reserved bool, lease string, err error)
+
+	// Release the lease of an api request
+	Release(lease string) error
+}
+
+// Memory keeps the state in the process, it's the default coordinator,
+// use Handler to share it with the other nodes
+type Memory struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	members map[string]*member
+	owner   *Node
+	auth    AuthFunc
+
+	// leaseTTL releases the leases that are not released in time, such as the node stops
+	leaseTTL time.Duration
+	leases   map[string]*lease
+}
+
+type lease struct {
+	release func()
+	timer   *time.Timer
+}
+
+type member struct {
+	node       Node
+	subdomains map[string]bool
+	beatAt     time.Time
+}
+
+var _ Coordinator = &Memory{}
+
+// NewMemory coordinator
+func NewMemory() *Memory {
+	return &Memory{
+		ttl:     DefaultTTL,
+		members: map[string]*member{},
+		leases:  map[string]*lease{},
+	}
+}
+
+// SetOwner sets the node that keeps the Memory, the auth checks the api requests of all the nodes.
+// The leases that are not released within the leaseTTL are released, it should be as long as an api request can last.
+func (m *Memory) SetOwner(node Node, auth AuthFunc, leaseTTL time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.owner = &node
+	m.auth = auth
+	m.leaseTTL = leaseTTL
+}
+
+// Heartbeat ...
+func (m *Memory) Heartbeat(node Node, subdomains []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	dict := map[string]bool{}
+	for _, s := range subdomains {
+		dict[s] = true
+	}
+	m.members[node.Name] = &member{node: node, subdomains: dict, beatAt: time.Now()}
+	return nil
+}
+
+// Nodes ...
+func (m *Memory) Nodes(subdomain string) ([]Node, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list := []Node{}
+	for _, mb := range m.alive() {
+		if mb.subdomains[subdomain] {
+			list = append(list, mb.node)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Node ...
+func (m *Memory) Node(name string) (*Node, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	mb, has := m.alive()[name]
+	if !has {
+		return nil, nil
+	}
+	return &mb.node, nil
+}
+
+// Owner ...
+func (m *Memory) Owner() (*Node, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.owner, nil
+}
+
+// Auth ...
+func (m *Memory) Auth(subdomain, key, token string) (bool, string, error) {
+	m.lock.Lock()
+	auth := m.auth
+	m.lock.Unlock()
+
+	if auth == nil {
+		return false, "", nil
+	}
+
+	reserved, release, err := auth(subdomain, key, token)
+	if err != nil {
+		return false, "", err
+	}
+
+	id := kit.RandString(16)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.leases[id] = &lease{
+		release: release,
+		timer:   time.AfterFunc(m.leaseTTL, func() { _ = m.Release(id) }),
+	}
+	return reserved, id, nil
+}
+
+// Release ...
+func (m *Memory) Release(id string) error {
+	m.lock.Lock()
+	l, has := m.leases[id]
+	delete(m.leases, id)
+	m.lock.Unlock()
+
+	if has {
+		l.timer.Stop()
+		l.release()
+	}
+	return nil
+}
+
+// alive removes the members that stop sending heartbeats, the caller should hold the lock
+func (m *Memory) alive() map[string]*member {
+	for name, mb := range m.members {
+		if time.Since(mb.beatAt) > m.ttl {
+			delete(m.members, name)
+		}
+	}
+	return m.members
+}
@@ -0,0 +1,142 @@
+package cluster
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	testCoordinator(t, newOwned())
+}
+
+func TestCache(t *testing.T) {
+	m := newOwned()
+	c := NewCache(m, 50*time.Millisecond)
+	testCoordinator(t, NewCache(newOwned(), 0))
+
+	a := Node{"a", "http://a"}
+	assert.Nil(t, c.Heartbeat(a, []string{"x"}))
+	nodes, _ := c.Nodes("x")
+	assert.Equal(t, []Node{a}, nodes)
+
+	// the membership is cached until the ttl
+	assert.Nil(t, m.Heartbeat(a, nil))
+	nodes, _ = c.Nodes("x")
+	assert.Equal(t, []Node{a}, nodes)
+
+	time.Sleep(100 * time.Millisecond)
+	nodes, _ = c.Nodes("x")
+	assert.Empty(t, nodes)
+}
+
+func TestLease(t *testing.T) {
+	released := make(chan string, 2)
+	m := NewMemory()
+	m.SetOwner(Node{"o", "http://o"}, func(subdomain, _, _ string) (bool, func(), error) {
+		return false, func() { released <- subdomain }, nil
+	}, 50*time.Millisecond)
+
+	_, lease, err := m.Auth("x", "", "")
+	assert.Nil(t, err)
+	assert.Nil(t, m.Release(lease))
+	assert.Equal(t, "x", <-released)
+
+	// release twice is fine
+	assert.Nil(t, m.Release(lease))
+
+	// the lease that is not released in time
+	_, _, err = m.Auth("y", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "y", <-released)
+}
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(Handler(newOwned(), "secret"))
+	defer srv.Close()
+
+	testCoordinator(t, NewClient(srv.URL, "digto.org", "secret"))
+
+	_, err := NewClient(srv.URL, "digto.org", "wrong").Nodes("a")
+	assert.EqualError(t, err, "invalid Digto-Cluster-Secret")
+}
+
+func TestTTL(t *testing.T) {
+	m := NewMemory()
+	m.ttl = 50 * time.Millisecond
+
+	a := Node{"a", "http://a"}
+	assert.Nil(t, m.Heartbeat(a, []string{"x"}))
+
+	nodes, _ := m.Nodes("x")
+	assert.Equal(t, []Node{a}, nodes)
+
+	// the node stops sending heartbeats
+	time.Sleep(100 * time.Millisecond)
+
+	nodes, _ = m.Nodes("x")
+	assert.Empty(t, nodes)
+	node, _ := m.Node("a")
+	assert.Nil(t, node)
+
+	// no owner, no auth
+	reserved, _, err := m.Auth("x", "", "")
+	assert.Nil(t, err)
+	assert.False(t, reserved)
+}
+
+func newOwned() *Memory {
+	m := NewMemory()
+	m.SetOwner(Node{"o", "http://o"}, func(subdomain, key, token string) (bool, func(), error) {
+		if key != "key" {
+			return false, nil, errors.New("invalid Digto-Key")
+		}
+		return subdomain == "x" && token == "token", func() {}, nil
+	}, time.Minute)
+	return m
+}
+
+func testCoordinator(t *testing.T, c Coordinator) {
+	a := Node{"a", "http://a"}
+	b := Node{"b", "http://b"}
+
+	assert.Nil(t, c.Heartbeat(a, []string{"x"}))
+	assert.Nil(t, c.Heartbeat(b, []string{"x", "y"}))
+
+	nodes, err := c.Nodes("x")
+	assert.Nil(t, err)
+	assert.Equal(t, []Node{a, b}, nodes)
+
+	// the heartbeat replaces the last report
+	assert.Nil(t, c.Heartbeat(b, []string{"y"}))
+	nodes, _ = c.Nodes("x")
+	assert.Equal(t, []Node{a}, nodes)
+
+	assert.Nil(t, c.Heartbeat(a, nil))
+	nodes, _ = c.Nodes("x")
+	assert.Empty(t, nodes)
+
+	node, err := c.Node("b")
+	assert.Nil(t, err)
+	assert.Equal(t, &b, node)
+
+	node, err = c.Node("c")
+	assert.Nil(t, err)
+	assert.Nil(t, node)
+
+	node, err = c.Owner()
+	assert.Nil(t, err)
+	assert.Equal(t, &Node{"o", "http://o"}, node)
+
+	reserved, lease, err := c.Auth("x", "key", "token")
+	assert.Nil(t, err)
+	assert.True(t, reserved)
+	assert.NotEmpty(t, lease)
+	assert.Nil(t, c.Release(lease))
+
+	_, _, err = c.Auth("x", "nope", "")
+	assert.EqualError(t, err, "invalid Digto-Key")
+}
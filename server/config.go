@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ysmood/digto/server/cert"
+	"github.com/ysmood/digto/server/ddns"
+	"gopkg.in/yaml.v2"
+)
+
+// Config of the server, check DefaultConfig and ServeConfig for the defaults. It can be loaded from a yaml or json file via LoadConfig,
+// the keys of the file are the yaml tags of the fields.
+type Config struct {
+	Host      string   `json:"host" yaml:"host"`
+	DBPath    string   `json:"db_path" yaml:"db_path"`
+	HTTPAddr  string   `json:"http_addr" yaml:"http_addr"`
+	HTTPSAddr string   `json:"https_addr" yaml:"https_addr"`
+	Timeout   Duration `json:"timeout" yaml:"timeout"`
+
+	// ShutdownTimeout is how long to wait for the in-flight requests when the server is shutting down
+	ShutdownTimeout Duration `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+
+	// DNSProvider and DNSConfig are for the dns-01 challenge, check cert.NewProvider
+	DNSProvider string            `json:"dns_provider" yaml:"dns_provider"`
+	DNSConfig   map[string]string `json:"dns_config" yaml:"dns_config"`
+
+	CADirURL       string       `json:"ca_dir_url" yaml:"ca_dir_url"`
+	Challenge      string       `json:"challenge" yaml:"challenge"`
+	CertSubdomains []string     `json:"cert_subdomains" yaml:"cert_subdomains"`
+	ACME           cert.Account `json:"acme" yaml:"acme"`
+
+	// IP and IPv6 are the sources of the dns records, check SetDDNS
+	IP           string   `json:"ip" yaml:"ip"`
+	IPv6         string   `json:"ipv6" yaml:"ipv6"`
+	DDNSInterval Duration `json:"ddns_interval" yaml:"ddns_interval"`
+
+	// MaxTCPPorts and MaxTCPPortsPerKey cap the ports of the raw tcp tunnels, check SetTCPLimit
+	MaxTCPPorts       int `json:"max_tcp_ports" yaml:"max_tcp_ports"`
+	MaxTCPPortsPerKey int `json:"max_tcp_ports_per_key" yaml:"max_tcp_ports_per_key"`
+
+	// ReservationTTL check SetReservationTTL
+	ReservationTTL Duration `json:"reservation_ttl" yaml:"reservation_ttl"`
+
+	AdminKey  string          `json:"admin_key" yaml:"admin_key"`
+	AccessLog AccessLogConfig `json:"access_log" yaml:"access_log"`
+	Cluster   ClusterConfig   `json:"cluster" yaml:"cluster"`
+}
+
+// ClusterConfig to run multiple servers behind a load balancer, empty Name disables it, check SetCluster.
+// The Name is unique for each node, the URL is how the other nodes reach the node, such as "http://10.0.0.2:80".
+// The Coordinator is the URL of the node that keeps the shared state, empty means this node keeps it.
+// The Secret is shared by all the nodes.
+type ClusterConfig struct {
+	Name        string `json:"name" yaml:"name"`
+	URL         string `json:"url" yaml:"url"`
+	Coordinator string `json:"coordinator" yaml:"coordinator"`
+	Secret      string `json:"secret" yaml:"secret"`
+}
+
+// AccessLogConfig the Path is the file to write the access log to, "-" for stdout, empty to disable it.
+// The file is rotated by the size in megabytes, the age is in days.
+type AccessLogConfig struct {
+	Path       string `json:"path" yaml:"path"`
+	MaxSize    int    `json:"max_size" yaml:"max_size"`
+	MaxBackups int    `json:"max_backups" yaml:"max_backups"`
+	MaxAge     int    `json:"max_age" yaml:"max_age"`
+}
+
+// Duration is written as a string in the config, such as "2m"
+type Duration time.Duration
+
+// UnmarshalJSON ...
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+// UnmarshalYAML ...
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// DefaultConfig is the base of New, the dns records are not updated and the tcp ports are not limited,
+// check ServeConfig for the defaults of the config files and the cli
+func DefaultConfig() Config {
+	return Config{
+		DBPath:          "digto.db",
+		HTTPAddr:        ":80",
+		HTTPSAddr:       ":443",
+		Timeout:         Duration(2 * time.Minute),
+		ShutdownTimeout: Duration(30 * time.Second),
+		DNSProvider:     "dnspod",
+		DNSConfig:       map[string]string{},
+		Challenge:       cert.DNS01,
+		ACME:            cert.Account{KeyType: "rsa2048"},
+		AccessLog:       AccessLogConfig{MaxSize: 100, MaxBackups: 10, MaxAge: 30},
+	}
+}
+
+// ServeConfig is the DefaultConfig with the defaults of a standalone server, the A records follow the public ip
+// every 5 minutes, the raw tcp tunnels are capped at 100 ports and 10 ports per api key
+func ServeConfig() Config {
+	c := DefaultConfig()
+	c.IP = "myip"
+	c.DDNSInterval = Duration(5 * time.Minute)
+	c.MaxTCPPorts = 100
+	c.MaxTCPPortsPerKey = 10
+	return c
+}
+
+// LoadConfig loads the yaml or json file on top of the ServeConfig, the format is decided by the extension.
+// Unknown keys are errors, so that typos won't be ignored silently.
+func LoadConfig(path string) (Config, error) {
+	c := ServeConfig()
+
+	var unmarshal func([]byte, interface{}) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.UnmarshalStrict
+	case ".json":
+		unmarshal = func(data []byte, v interface{}) error {
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.DisallowUnknownFields()
+			return dec.Decode(v)
+		}
+	case ".toml":
+		return c, fmt.Errorf("toml config is not supported: %s, convert it to yaml or json", path)
+	default:
+		return c, fmt.Errorf("config format not supported: %s, use .yaml, .yml or .json", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+
+	err = unmarshal(data, &c)
+	if err != nil {
+		return c, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// LoadEnv overrides the config with the env vars. The name of the env var is the upper case of the yaml key
+// with the "DIGTO_" prefix, the keys of the nested ones are joined with "_", such as DIGTO_HOST and DIGTO_ACME_EMAIL.
+// The lists are comma separated, the dns_config is the same as the --dns-config flag.
+func (c *Config) LoadEnv() error {
+	return loadEnv(reflect.ValueOf(c).Elem(), "DIGTO")
+}
+
+func loadEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + "_" + strings.ToUpper(v.Type().Field(i).Tag.Get("yaml"))
+
+		if field.Kind() == reflect.Struct {
+			err := loadEnv(field, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, has := os.LookupEnv(name)
+		if !has {
+			continue
+		}
+
+		err := setField(field, s)
+		if err != nil {
+			return fmt.Errorf("invalid env %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, s string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case Duration:
+		var d Duration
+		err := d.set(s)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(d))
+	case []string:
+		field.Set(reflect.ValueOf(strings.Split(s, ",")))
+	case map[string]string:
+		m, err := cert.ParseConfig(s)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("type not supported: %s", field.Type())
+	}
+	return nil
+}
+
+// Validate returns all the problems of the config as one error
+func (c Config) Validate() error {
+	list := []string{}
+	add := func(err error) {
+		if err != nil {
+			list = append(list, err.Error())
+		}
+	}
+
+	if c.Host == "" {
+		list = append(list, "host is required")
+	}
+	if c.DBPath == "" {
+		list = append(list, "db_path is required")
+	}
+	if c.Timeout <= 0 {
+		list = append(list, "timeout must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		list = append(list, "shutdown_timeout must be positive")
+	}
+	if c.DDNSInterval < 0 {
+		list = append(list, "ddns_interval can't be negative")
+	}
+	if c.ReservationTTL < 0 {
+		list = append(list, "reservation_ttl can't be negative")
+	}
+	if c.MaxTCPPorts < 0 || c.MaxTCPPortsPerKey < 0 {
+		list = append(list, "max_tcp_ports and max_tcp_ports_per_key can't be negative")
+	}
+
+	switch c.Challenge {
+	case cert.DNS01, cert.HTTP01, cert.TLSALPN01, cert.LocalCA:
+	default:
+		list = append(list, "challenge not supported: "+c.Challenge)
+	}
+
+	add(c.ACME.Validate())
+
+	if c.Cluster.Name != "" {
+		if strings.Contains(c.Cluster.Name, ".") {
+			list = append(list, "cluster.name can't contain dots")
+		}
+		if c.Cluster.URL == "" {
+			list = append(list, "cluster.url is required")
+		}
+		if c.Cluster.Secret == "" {
+			list = append(list, "cluster.secret is required")
+		}
+	}
+
+	for _, s := range []string{c.IP, c.IPv6} {
+		if s != "" {
+			_, err := ddns.ParseSource(s)
+			add(err)
+		}
+	}
+
+	if len(list) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config: %s", strings.Join(list, "; "))
+}
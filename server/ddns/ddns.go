@@ -0,0 +1,187 @@
+package ddns
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ysmood/kit"
+	"github.com/ysmood/myip"
+)
+
+// the record types
+const (
+	A    = "A"
+	AAAA = "AAAA"
+)
+
+// Records sets the dns records of a domain
+type Records interface {
+	// SetRecord creates or updates the record of the subdomain, such as "@" or "*"
+	SetRecord(subdomain, domain, recordType, value string) error
+}
+
+// NewRecords returns nil if the provider is not supported, the config is the same as the cert.NewProvider
+func NewRecords(provider string, config map[string]string) Records {
+	switch provider {
+	case "dnspod":
+		token := config["token"]
+		if token == "" {
+			token = config["DNSPOD_API_KEY"]
+		}
+		return &Dnspod{Token: token}
+	}
+	return nil
+}
+
+// Source gets the current ip of the server
+type Source func() (string, error)
+
+// ParseSource parses the source of the ip, it can be:
+// "myip" for the public ip from the google dns, "interface" for the ip of the network interface,
+// a http url that responds the ip as plain text such as "https://api6.ipify.org", or a fixed ip.
+func ParseSource(s string) (Source, error) {
+	switch {
+	case s == "myip":
+		return myip.GetPublicIP, nil
+	case s == "interface":
+		return myip.GetInterfaceIP, nil
+	case strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://"):
+		return httpSource(s), nil
+	case net.ParseIP(s) != nil:
+		return func() (string, error) { return s, nil }, nil
+	}
+	return nil, fmt.Errorf("invalid ip source: %s", s)
+}
+
+func httpSource(u string) Source {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	return func() (string, error) {
+		res, err := client.Get(u)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = res.Body.Close() }()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(body)), nil
+	}
+}
+
+// Watcher keeps the "@" and "*" records of the host pointing to the current ips of the server
+type Watcher struct {
+	host    string
+	records Records
+
+	lock    sync.Mutex
+	sources map[string]Source
+	last    map[string]string
+}
+
+// New watcher, the A record uses the public ip by default
+func New(host string, records Records) *Watcher {
+	return &Watcher{
+		host:    host,
+		records: records,
+		sources: map[string]Source{A: myip.GetPublicIP},
+		last:    map[string]string{},
+	}
+}
+
+// SetSource sets the source of the record type, nil to stop managing the record type
+func (w *Watcher) SetSource(recordType string, s Source) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if s == nil {
+		delete(w.sources, recordType)
+	} else {
+		w.sources[recordType] = s
+	}
+	delete(w.last, recordType)
+}
+
+// Update the records whose ips have changed since the last update
+func (w *Watcher) Update() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// the A and AAAA records are updated independently, a broken source of one won't block the other
+	msgs := []string{}
+	for _, recordType := range []string{A, AAAA} {
+		err := w.update(recordType)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// update the records of the type, the caller should hold the lock
+func (w *Watcher) update(recordType string) error {
+	source, has := w.sources[recordType]
+	if !has {
+		return nil
+	}
+
+	ip, err := source()
+	if err != nil {
+		return err
+	}
+	err = checkIP(recordType, ip)
+	if err != nil {
+		return err
+	}
+	if ip == w.last[recordType] {
+		return nil
+	}
+
+	for _, sub := range []string{"*", "@"} {
+		err = w.records.SetRecord(sub, w.host, recordType, ip)
+		if err != nil {
+			return err
+		}
+	}
+	w.last[recordType] = ip
+	kit.Log("[digto] dns", recordType, "records of", w.host, "updated to", ip)
+	return nil
+}
+
+// Watch calls Update every interval until the stop is closed
+func (w *Watcher) Watch(interval time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+
+		err := w.Update()
+		if err != nil {
+			kit.Err("[digto] failed to update the dns records", err)
+		}
+	}
+}
+
+func checkIP(recordType, ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return errors.New("invalid ip: " + ip)
+	}
+	if (parsed.To4() != nil) != (recordType == A) {
+		return fmt.Errorf("the ip %s doesn't match the record type %s", ip, recordType)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package ddns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRecords struct {
+	records map[string]string
+	calls   int
+}
+
+func (r *fakeRecords) SetRecord(subdomain, domain, recordType, value string) error {
+	r.calls++
+	r.records[recordType+" "+subdomain+"."+domain] = value
+	return nil
+}
+
+func TestWatcher(t *testing.T) {
+	records := &fakeRecords{records: map[string]string{}}
+	w := New("digto.org", records)
+
+	ip := "1.2.3.4"
+	w.SetSource(A, func() (string, error) { return ip, nil })
+	ipv6, err := ParseSource("::1")
+	assert.Nil(t, err)
+	w.SetSource(AAAA, ipv6)
+
+	assert.Nil(t, w.Update())
+	assert.Equal(t, map[string]string{
+		"A *.digto.org":    "1.2.3.4",
+		"A @.digto.org":    "1.2.3.4",
+		"AAAA *.digto.org": "::1",
+		"AAAA @.digto.org": "::1",
+	}, records.records)
+
+	// only the changed ones are updated
+	assert.Nil(t, w.Update())
+	assert.Equal(t, 4, records.calls)
+
+	ip = "5.6.7.8"
+	assert.Nil(t, w.Update())
+	assert.Equal(t, 6, records.calls)
+	assert.Equal(t, "5.6.7.8", records.records["A @.digto.org"])
+
+	ip = "::2"
+	assert.EqualError(t, w.Update(), "the ip ::2 doesn't match the record type A")
+
+	// the AAAA records are still updated when the A source fails
+	w.SetSource(A, func() (string, error) { return "", errors.New("err") })
+	w.SetSource(AAAA, func() (string, error) { return "::2", nil })
+	assert.EqualError(t, w.Update(), "err")
+	assert.Equal(t, "::2", records.records["AAAA @.digto.org"])
+	assert.Equal(t, 8, records.calls)
+
+	w.SetSource(AAAA, func() (string, error) { return "1.2.3.4", nil })
+	assert.EqualError(t, w.Update(), "err; the ip 1.2.3.4 doesn't match the record type AAAA")
+	w.SetSource(AAAA, nil)
+
+	w.SetSource(A, nil)
+	assert.Nil(t, w.Update())
+	assert.Equal(t, 8, records.calls)
+}
+
+func TestParseSource(t *testing.T) {
+	for _, s := range []string{"myip", "interface", "https://api6.ipify.org", "1.2.3.4", "::1"} {
+		_, err := ParseSource(s)
+		assert.Nil(t, err)
+	}
+
+	_, err := ParseSource("nope")
+	assert.EqualError(t, err, "invalid ip source: nope")
+
+	assert.Nil(t, NewRecords("rfc2136", nil))
+	assert.Equal(t, &Dnspod{Token: "t"}, NewRecords("dnspod", map[string]string{"token": "t"}))
+	assert.Equal(t, &Dnspod{Token: "t"}, NewRecords("dnspod", map[string]string{"DNSPOD_API_KEY": "t"}))
+}
@@ -0,0 +1,73 @@
+package ddns
+
+import (
+	"errors"
+
+	"github.com/ysmood/kit"
+)
+
+// Dnspod manages the records via the api of dnspod.cn
+type Dnspod struct {
+	Token string
+}
+
+var _ Records = &Dnspod{}
+
+// SetRecord ...
+func (pod *Dnspod) SetRecord(subdomain, domain, recordType, value string) error {
+	recordID, err := pod.getRecordID(subdomain, domain, recordType, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = pod.req("Record.Modify",
+		"sub_domain", subdomain,
+		"domain", domain,
+		"record_id", recordID,
+		"record_type", recordType,
+		"record_line", "默认",
+		"value", value,
+	)
+	return err
+}
+
+// getRecordID creates the record if it doesn't exist
+func (pod *Dnspod) getRecordID(subdomain, domain, recordType, value string) (string, error) {
+	data, err := pod.req("Record.List",
+		"sub_domain", subdomain,
+		"domain", domain,
+		"record_type", recordType,
+	)
+	if err == nil {
+		return data.Get("records.0.id").String(), nil
+	}
+	if err.Error() != "No records" {
+		return "", err
+	}
+
+	data, err = pod.req("Record.Create",
+		"sub_domain", subdomain,
+		"domain", domain,
+		"record_type", recordType,
+		"record_line", "默认",
+		"value", value,
+	)
+	if err != nil {
+		return "", err
+	}
+	return data.Get("record.id").String(), nil
+}
+
+func (pod *Dnspod) req(path string, params ...interface{}) (kit.JSONResult, error) {
+	params = append(params, "login_token", pod.Token, "format", "json")
+
+	data, err := kit.Req("https://dnsapi.cn/" + path).Post().Form(params...).JSON()
+	if err != nil {
+		return nil, err
+	}
+
+	if data.Get("status.code").String() != "1" {
+		return data, errors.New(data.Get("status.message").String())
+	}
+	return data, nil
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ysmood/digto/server/cert"
+	"github.com/ysmood/kit"
+	"github.com/ysmood/storer"
+)
+
+// ErrDomainTaken ...
+var ErrDomainTaken = errors.New("the domain is already used by another subdomain")
+
+// ErrNotReserved ...
+var ErrNotReserved = errors.New("reserve the subdomain before adding a custom domain")
+
+// lookupCNAME is replaced by the tests
+var lookupCNAME = net.LookupCNAME
+
+// domain maps a custom domain to a subdomain
+type domain struct {
+	Name      string
+	Subdomain string
+	CreatedAt time.Time
+}
+
+// domains routes the custom domains, the owner of a domain proves it by pointing its CNAME to the subdomain
+type domains struct {
+	host  string
+	store *storer.Store
+	dict  *storer.Map
+	certs *storer.Map
+
+	// added and removed are called after a domain is added or removed
+	added   func(name string)
+	removed func(name string)
+}
+
+func newDomains(host string, store *storer.Store) *domains {
+	return &domains{
+		host:    host,
+		store:   store,
+		dict:    store.MapWithName("domains", &domain{}),
+		certs:   store.MapWithName("domain-certs", &[]byte{}),
+		added:   func(string) {},
+		removed: func(string) {},
+	}
+}
+
+// subdomain returns the subdomain of the host, the host is either "{subdomain}.{p.host}" or a custom domain
+func (d *domains) subdomain(host string) string {
+	if strings.HasSuffix(host, "."+d.host) {
+		return strings.TrimSuffix(host, "."+d.host)
+	}
+
+	item, has := d.get(host)
+	if has {
+		return item.Subdomain
+	}
+	return strings.Replace(host, "."+d.host, "", 1)
+}
+
+func (d *domains) get(name string) (*domain, bool) {
+	var item domain
+	err := d.dict.Get(name, &item)
+	if err != nil {
+		if err != storer.ErrKeyNotFound {
+			kit.Err(err)
+		}
+		return nil, false
+	}
+	return &item, true
+}
+
+// add maps the domain to the subdomain after its CNAME is verified
+func (d *domains) add(subdomain, name string) (*domain, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" || strings.ContainsAny(name, ":/") || name == d.host || strings.HasSuffix(name, "."+d.host) {
+		return nil, errors.New("invalid domain: " + name)
+	}
+
+	err := d.verify(subdomain, name)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &domain{Name: name, Subdomain: subdomain, CreatedAt: time.Now()}
+
+	err = d.store.Update(func(txn storer.Txn) error {
+		dict := d.dict.Txn(txn)
+
+		var old domain
+		err := dict.Get(name, &old)
+		if err == nil && old.Subdomain != subdomain {
+			return ErrDomainTaken
+		}
+		if err != nil && err != storer.ErrKeyNotFound {
+			return err
+		}
+
+		return dict.Set(name, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d.added(name)
+	return item, nil
+}
+
+// verify the CNAME of the domain points to the subdomain
+func (d *domains) verify(subdomain, name string) error {
+	target := subdomain + "." + d.host
+	cname, err := lookupCNAME(name)
+	if err != nil || strings.TrimSuffix(cname, ".") != target {
+		return errors.New("the CNAME of " + name + " must be " + target)
+	}
+	return nil
+}
+
+func (d *domains) remove(subdomain, name string) error {
+	err := d.store.Update(func(txn storer.Txn) error {
+		dict := d.dict.Txn(txn)
+
+		var item domain
+		err := dict.Get(name, &item)
+		if err == storer.ErrKeyNotFound || (err == nil && item.Subdomain != subdomain) {
+			return errors.New("domain not found: " + name)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = d.certs.Txn(txn).Del(name)
+		if err != nil && err != storer.ErrKeyNotFound {
+			return err
+		}
+		return dict.Del(name)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.removed(name)
+	return nil
+}
+
+func (d *domains) list(subdomain string) ([]domain, error) {
+	list := []domain{}
+	err := d.store.View(func(txn storer.Txn) error {
+		dict := d.dict.Txn(txn)
+		return dict.Each(func(id []byte) error {
+			var item domain
+			err := dict.GetByBytes(id, &item)
+			if err != nil {
+				return err
+			}
+			if item.Subdomain == subdomain {
+				list = append(list, item)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+// handle POST to add the domain of the "name" query, DELETE to remove it, GET to list the domains of the subdomain
+func (d *domains) handle(subdomain string, reserved bool, ctx kit.GinContext) {
+	switch ctx.Request.Method {
+	case http.MethodGet:
+		list, err := d.list(subdomain)
+		if err != nil {
+			apiError(ctx, err.Error())
+			return
+		}
+		ctx.JSON(http.StatusOK, list)
+
+	case http.MethodPost:
+		if !reserved {
+			apiError(ctx, ErrNotReserved.Error())
+			return
+		}
+		item, err := d.add(subdomain, ctx.Query("name"))
+		if err != nil {
+			apiError(ctx, err.Error())
+			return
+		}
+		ctx.JSON(http.StatusOK, item)
+
+	case http.MethodDelete:
+		err := d.remove(subdomain, ctx.Query("name"))
+		if err != nil {
+			apiError(ctx, err.Error())
+		}
+
+	default:
+		apiError(ctx, "method not allowed: "+ctx.Request.Method)
+	}
+}
+
+// domainCache stores the certificate of a custom domain
+type domainCache struct {
+	dict *storer.Map
+	name string
+}
+
+var _ cert.Cache = &domainCache{}
+
+func (c *domainCache) Get() ([]byte, error) {
+	var data []byte
+	err := c.dict.Get(c.name, &data)
+	if err == storer.ErrKeyNotFound {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (c *domainCache) Set(data []byte) error {
+	return c.dict.Set(c.name, &data)
+}
+
+// domainCert returns the context of the custom domain's certificate, nil if the name is not a custom domain
+func (ctx *Context) domainCert(name string) *cert.Context {
+	if _, has := ctx.proxy.domains.get(name); !has {
+		return nil
+	}
+
+	ctx.domainLock.Lock()
+	defer ctx.domainLock.Unlock()
+
+	if c, has := ctx.domainCerts[name]; has {
+		return c
+	}
+	if ctx.domainCerts == nil {
+		ctx.domainCerts = map[string]*cert.Context{}
+	}
+
+	// the dns provider can't manage the records of the custom domains, so the dns-01 is not an option
+	challenge := cert.HTTP01
+	if ctx.cert != nil {
+		if s := ctx.cert.Status().Challenge; s == cert.TLSALPN01 || s == cert.LocalCA {
+			challenge = s
+		}
+	}
+
+	c, err := cert.New(cert.Options{
+		Host:         name,
+		Challenge:    challenge,
+		CADirURL:     ctx.caDirURL,
+		Cache:        &domainCache{ctx.proxy.domains.certs, name},
+		CACache:      &cache{ctx.caCache},
+		AccountCache: &cache{ctx.accountCache},
+		Account:      ctx.account,
+	})
+	if err != nil {
+		kit.Err("[digto]", name, err)
+		return nil
+	}
+	ctx.domainCerts[name] = c
+	return c
+}
+
+// updateDomainCert obtains or renews the certificate of the custom domain in background, it does nothing if
+// the certificate is not enabled or an update of the domain is running. The CNAME is verified again before each
+// update, so the certificate of a domain that no longer points to the server won't be renewed.
+func (ctx *Context) updateDomainCert(name string) {
+	if ctx.cert == nil {
+		return
+	}
+
+	c := ctx.domainCert(name)
+	if c == nil {
+		return
+	}
+
+	ctx.domainLock.Lock()
+	defer ctx.domainLock.Unlock()
+
+	if ctx.domainUpdating[name] {
+		return
+	}
+	if ctx.domainUpdating == nil {
+		ctx.domainUpdating = map[string]bool{}
+	}
+	ctx.domainUpdating[name] = true
+
+	go func() {
+		defer func() {
+			ctx.domainLock.Lock()
+			delete(ctx.domainUpdating, name)
+			ctx.domainLock.Unlock()
+		}()
+
+		item, has := ctx.proxy.domains.get(name)
+		if !has {
+			return
+		}
+		err := ctx.proxy.domains.verify(item.Subdomain, name)
+		if err != nil {
+			c.Fail(err)
+		} else {
+			err = c.Update()
+		}
+		if err != nil {
+			kit.Err("[digto]", name, err)
+		}
+
+		// the domain is removed while it's updating
+		if _, has := ctx.proxy.domains.get(name); !has {
+			ctx.removeDomainCert(name)
+		}
+	}()
+}
+
+// removeDomainCert drops the certificate of the removed custom domain
+func (ctx *Context) removeDomainCert(name string) {
+	ctx.domainLock.Lock()
+	delete(ctx.domainCerts, name)
+	ctx.domainLock.Unlock()
+
+	err := ctx.proxy.domains.certs.Del(name)
+	if err != nil && err != storer.ErrKeyNotFound {
+		kit.Err("[digto]", name, err)
+	}
+}
+
+// getDomainCert returns the certificate of the custom domain, nil if it's not obtained yet, so that the main
+// certificate is served until then. The certificate is obtained or renewed in background when it's due.
+func (ctx *Context) getDomainCert(hello *tls.ClientHelloInfo) *tls.Certificate {
+	c := ctx.domainCert(hello.ServerName)
+	if c == nil {
+		return nil
+	}
+
+	if crt := c.TLSALPNCert(hello); crt != nil {
+		return crt
+	}
+
+	if c.NextAttempt() <= 0 {
+		ctx.updateDomainCert(hello.ServerName)
+	}
+	return c.Cert()
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/ysmood/digto/server/cert"
+)
+
+// SetLookupCNAME replaces the dns lookup of the custom domains
+func SetLookupCNAME(fn func(string) (string, error)) {
+	lookupCNAME = fn
+}
+
+// SetKeyLease changes how long a subdomain is still counted for the api key after its last api request
+func SetKeyLease(ctx *Context, d time.Duration) {
+	ctx.proxy.keys.lease = d
+}
+
+// SetQueueTimeout changes how long a delivered message waits for the response before it's re-queued
+func SetQueueTimeout(ctx *Context, d time.Duration) {
+	ctx.proxy.queue.timeout = d
+}
+
+// GetDomainCert returns the certificate of the custom domain for the tls handshakes
+func GetDomainCert(ctx *Context, name string) *tls.Certificate {
+	return ctx.getDomainCert(&tls.ClientHelloInfo{ServerName: name})
+}
+
+// DomainCertStatus returns the status of the custom domain's certificate
+func DomainCertStatus(ctx *Context, name string) cert.Status {
+	return ctx.domainCert(name).Status()
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ysmood/kit"
+	"github.com/ysmood/storer"
+)
+
+// the max bytes of each body to capture
+const inspectBodyLimit = 16 * 1024
+
+// the max records to keep for each subdomain
+const inspectSize = 50
+
+// record of a public request and its response
+type record struct {
+	ID        string
+	Subdomain string
+	Method    string
+	URL       string
+	Host      string
+	Header    http.Header
+	Body      []byte
+	// BodyTruncated is true if the request body is not fully captured, such as it exceeds the capture limit,
+	// or the body of unknown length is not read by any consumer
+	BodyTruncated bool
+	Status        int
+	ResHeader     http.Header
+	ResBody       []byte
+	StartedAt     time.Time
+	Duration      time.Duration
+
+	// lock guards the captured bodies, the consumer's goroutine may still be writing the public response
+	// or reading the public request while the record ends
+	lock    sync.Mutex
+	reqBody *limitedBuffer
+	resBody *limitedBuffer
+	reqTee  *captureReader
+}
+
+// inspector persists the recent requests of each subdomain as a ring
+type inspector struct {
+	store   *storer.Store
+	records *storer.Map
+	rings   *storer.Map
+}
+
+// ring the record ids of a subdomain, oldest first
+type ring struct {
+	IDs []string
+}
+
+func newInspector(store *storer.Store) *inspector {
+	return &inspector{
+		store:   store,
+		records: store.MapWithName("records", &record{}),
+		rings:   store.MapWithName("record-rings", &ring{}),
+	}
+}
+
+// start capturing the public request, the request body and the response writer will be wrapped.
+// The body within the capture limit is read before any consumer takes the request,
+// so that the record of a request that arrives while no client is online can still be replayed.
+func (ins *inspector) start(id, subdomain string, ctx kit.GinContext) *record {
+	rec := &record{
+		ID:        id,
+		Subdomain: subdomain,
+		Method:    ctx.Request.Method,
+		URL:       ctx.Request.URL.String(),
+		Host:      ctx.Request.Host,
+		Header:    ctx.Request.Header.Clone(),
+		StartedAt: time.Now(),
+		reqBody:   &limitedBuffer{limit: inspectBodyLimit},
+		resBody:   &limitedBuffer{limit: inspectBodyLimit},
+	}
+
+	if n := ctx.Request.ContentLength; n >= 0 && n <= inspectBodyLimit {
+		ctx.Request.Body = rec.readBody(ctx.Request.Body, n)
+	} else {
+		rec.reqTee = &captureReader{body: ctx.Request.Body, rec: rec}
+		ctx.Request.Body = rec.reqTee
+	}
+	ctx.Writer = &captureWriter{ctx.Writer, rec}
+
+	return rec
+}
+
+// readBody reads the body of length n into the record, the returned body reads the same data
+func (rec *record) readBody(body io.ReadCloser, n int64) io.ReadCloser {
+	data, err := ioutil.ReadAll(io.LimitReader(body, n))
+	if err != nil || int64(len(data)) < n {
+		rec.reqBody.truncated = true
+	}
+	_, _ = rec.reqBody.Write(data)
+
+	return &readCloser{io.MultiReader(bytes.NewReader(data), body), body}
+}
+
+// end capturing and save the record, the oldest record will be removed if the ring is full
+func (ins *inspector) end(rec *record, ctx kit.GinContext) {
+	rec.Status = ctx.Writer.Status()
+	rec.ResHeader = ctx.Writer.Header().Clone()
+	rec.Duration = time.Since(rec.StartedAt)
+
+	rec.lock.Lock()
+	rec.Body = append([]byte{}, rec.reqBody.Bytes()...)
+	rec.BodyTruncated = rec.reqBody.truncated || (rec.reqTee != nil && !rec.reqTee.eof)
+	rec.ResBody = append([]byte{}, rec.resBody.Bytes()...)
+	rec.lock.Unlock()
+
+	err := ins.store.Update(func(txn storer.Txn) error {
+		rings := ins.rings.Txn(txn)
+		records := ins.records.Txn(txn)
+
+		var r ring
+		err := rings.Get(rec.Subdomain, &r)
+		if err != nil && err != storer.ErrKeyNotFound {
+			return err
+		}
+
+		r.IDs = append(r.IDs, rec.ID)
+		for len(r.IDs) > inspectSize {
+			err = records.Del(recordKey(rec.Subdomain, r.IDs[0]))
+			if err != nil {
+				return err
+			}
+			r.IDs = r.IDs[1:]
+		}
+
+		err = records.Set(recordKey(rec.Subdomain, rec.ID), rec)
+		if err != nil {
+			return err
+		}
+		return rings.Set(rec.Subdomain, &r)
+	})
+	if err != nil {
+		kit.Err(err)
+	}
+}
+
+// list the records of the subdomain, the latest first
+func (ins *inspector) list(subdomain string) ([]*record, error) {
+	list := []*record{}
+	err := ins.store.View(func(txn storer.Txn) error {
+		records := ins.records.Txn(txn)
+
+		var r ring
+		err := ins.rings.Txn(txn).Get(subdomain, &r)
+		if err == storer.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for i := len(r.IDs) - 1; i >= 0; i-- {
+			var rec record
+			err = records.Get(recordKey(subdomain, r.IDs[i]), &rec)
+			if err != nil {
+				return err
+			}
+			list = append(list, &rec)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// get a record of the subdomain
+func (ins *inspector) get(subdomain, id string) (*record, error) {
+	var rec record
+	return &rec, ins.records.Get(recordKey(subdomain, id), &rec)
+}
+
+func recordKey(subdomain, id string) string {
+	return subdomain + "/" + id
+}
+
+// handle GET "/{subdomain}/inspect", use the "format=json" query to get the json
+func (ins *inspector) handle(subdomain string, ctx kit.GinContext) {
+	list, err := ins.list(subdomain)
+	if err != nil {
+		apiError(ctx, err.Error())
+		return
+	}
+
+	if ctx.Query("format") == "json" {
+		ctx.JSON(http.StatusOK, list)
+		return
+	}
+
+	ctx.Header("Content-Type", "text/html; charset=utf-8")
+	err = inspectPage.Execute(ctx.Writer, gin.H{
+		"subdomain": subdomain,
+		"list":      list,
+	})
+	if err != nil {
+		kit.Err(err)
+	}
+}
+
+var inspectPage = template.Must(template.New("inspect").Funcs(template.FuncMap{
+	"body": func(b []byte) string {
+		if !utf8.Valid(b) {
+			return "(binary)"
+		}
+		return string(b)
+	},
+	"time": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Digto Inspector - {{.subdomain}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+summary { cursor: pointer; padding: 0.3em 0; font-family: monospace; }
+pre { background: #f5f5f5; padding: 0.5em; overflow: auto; max-height: 20em; }
+.status { display: inline-block; width: 3em; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{.subdomain}}</h1>
+<p>{{len .list}} recent requests, refresh the page to update.</p>
+{{range .list}}
+<details>
+<summary>
+<span class="status">{{.Status}}</span> {{.Method}} {{.URL}} <small>{{time .StartedAt}} {{.Duration}} {{.ID}}</small>
+</summary>
+<h4>Request</h4>
+<pre>{{.Method}} {{.URL}}
+Host: {{.Host}}
+{{range $k, $l := .Header}}{{range $l}}{{$k}}: {{.}}
+{{end}}{{end}}
+{{body .Body}}</pre>
+<h4>Response</h4>
+<pre>{{.Status}}
+{{range $k, $l := .ResHeader}}{{range $l}}{{$k}}: {{.}}
+{{end}}{{end}}
+{{body .ResBody}}</pre>
+</details>
+{{end}}
+</body>
+</html>
+`))
+
+// limitedBuffer discards the data after the limit
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - b.Len()
+	if room >= len(p) {
+		room = len(p)
+	} else {
+		b.truncated = true
+	}
+	if room > 0 {
+		_, _ = b.Buffer.Write(p[:room])
+	}
+	return len(p), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// captureReader copies the body to the record as it's read, eof is true after the body is fully read
+type captureReader struct {
+	body io.ReadCloser
+	rec  *record
+	eof  bool
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+
+	r.rec.lock.Lock()
+	_, _ = r.rec.reqBody.Write(p[:n])
+	if err == io.EOF {
+		r.eof = true
+	}
+	r.rec.lock.Unlock()
+
+	return n, err
+}
+
+func (r *captureReader) Close() error {
+	return r.body.Close()
+}
+
+// captureWriter copies the response body to the record
+type captureWriter struct {
+	gin.ResponseWriter
+	rec *record
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.rec.lock.Lock()
+	_, _ = w.rec.resBody.Write(p)
+	w.rec.lock.Unlock()
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.rec.lock.Lock()
+	_, _ = io.WriteString(w.rec.resBody, s)
+	w.rec.lock.Unlock()
+
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ysmood/kit"
+	"github.com/ysmood/storer"
+)
+
+// ErrInvalidKey ...
+var ErrInvalidKey = errors.New("invalid Digto-Key")
+
+// ErrRequestQuota ...
+var ErrRequestQuota = errors.New("request quota of the key is exceeded")
+
+// ErrSubdomainQuota ...
+var ErrSubdomainQuota = errors.New("concurrent subdomain quota of the key is exceeded")
+
+type apiKey struct {
+	ID   string
+	Name string
+
+	// Hash the sha256 of the key, the key itself is never stored
+	Hash string
+
+	// MaxSubdomains the max number of subdomains the key can consume at the same time, 0 means no limit
+	MaxSubdomains int
+
+	// MaxRequests the max number of api requests the key can make, 0 means no limit
+	MaxRequests int
+
+	Requests  int
+	CreatedAt time.Time
+}
+
+// keys manages the api keys, the authentication is disabled if the adminKey is empty
+type keys struct {
+	adminKey string
+	store    *storer.Store
+	dict     *storer.Map
+
+	// lease is how long a subdomain is still counted for the key after its last api request,
+	// so that the gap between two polls won't free the slot
+	lease time.Duration
+
+	lock sync.Mutex
+	// cache key id -> the key with the request count not saved yet
+	cache map[string]*keyUsage
+	// active key id -> subdomain -> lease
+	active map[string]map[string]*subdomainLease
+}
+
+// keyUsage the request count is saved at most once per keySaveInterval
+type keyUsage struct {
+	item    apiKey
+	unsaved int
+	savedAt time.Time
+}
+
+const keySaveInterval = time.Second
+
+// subdomainLease is active while there are ongoing api requests or before the until
+type subdomainLease struct {
+	requests int
+	until    time.Time
+}
+
+func (l *subdomainLease) active() bool {
+	return l.requests > 0 || time.Now().Before(l.until)
+}
+
+func newKeys(store *storer.Store) *keys {
+	return &keys{
+		store:  store,
+		dict:   store.MapWithName("keys", &apiKey{}),
+		lease:  time.Minute,
+		cache:  map[string]*keyUsage{},
+		active: map[string]map[string]*subdomainLease{},
+	}
+}
+
+// create a key, the returned string is the secret to use it, the format is "{id}.{secret}"
+func (k *keys) create(name string, maxSubdomains, maxRequests int) (string, *apiKey, error) {
+	item := &apiKey{
+		ID:            randString(),
+		Name:          name,
+		MaxSubdomains: maxSubdomains,
+		MaxRequests:   maxRequests,
+		CreatedAt:     time.Now(),
+	}
+	key := item.ID + "." + randString() + randString()
+	item.Hash = hashToken(key)
+
+	return key, item, k.dict.Set(item.ID, item)
+}
+
+func (k *keys) list() ([]apiKey, error) {
+	err := k.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []apiKey{}
+	err = k.store.View(func(txn storer.Txn) error {
+		dict := k.dict.Txn(txn)
+		return dict.Each(func(id []byte) error {
+			var item apiKey
+			err := dict.GetByBytes(id, &item)
+			if err != nil {
+				return err
+			}
+			list = append(list, item)
+			return nil
+		})
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+
+	return list, err
+}
+
+// revoke flushes the unsaved usage of the key before it's deleted, the lock is held till the end,
+// so that a concurrent api request can't load the key into the cache again
+func (k *keys) revoke(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if u, has := k.cache[id]; has {
+		err := k.save(id, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := k.store.Update(func(txn storer.Txn) error {
+		dict := k.dict.Txn(txn)
+
+		var item apiKey
+		err := dict.Get(id, &item)
+		if err != nil {
+			return err
+		}
+
+		return dict.Del(id)
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(k.cache, id)
+	delete(k.active, id)
+	return nil
+}
+
+// use checks the key and the quotas, call the returned function when the api request is done.
+// The subdomain is counted for the key until the lease after the last api request of it ends.
+func (k *keys) use(key, subdomain string) (func(), error) {
+	if k.adminKey == "" {
+		return func() {}, nil
+	}
+
+	id := keyID(key)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	u, err := k.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(u.item.Hash), []byte(hashToken(key))) != 1 {
+		return nil, ErrInvalidKey
+	}
+
+	if u.item.MaxRequests > 0 && u.item.Requests >= u.item.MaxRequests {
+		return nil, ErrRequestQuota
+	}
+
+	subdomains, has := k.active[id]
+	if !has {
+		subdomains = map[string]*subdomainLease{}
+		k.active[id] = subdomains
+	}
+	for name, l := range subdomains {
+		if !l.active() {
+			delete(subdomains, name)
+		}
+	}
+
+	l, has := subdomains[subdomain]
+	if !has && u.item.MaxSubdomains > 0 && len(subdomains) >= u.item.MaxSubdomains {
+		return nil, ErrSubdomainQuota
+	}
+
+	// only the accepted requests are counted
+	u.item.Requests++
+	u.unsaved++
+	if time.Since(u.savedAt) > keySaveInterval {
+		err = k.save(id, u)
+		if err != nil {
+			kit.Err("[digto] failed to save the key usage", err)
+		}
+	}
+
+	if !has {
+		l = &subdomainLease{}
+		subdomains[subdomain] = l
+	}
+	l.requests++
+
+	return func() {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+
+		l.requests--
+		l.until = time.Now().Add(k.lease)
+	}, nil
+}
+
+// load the key from the cache or the database, the caller should hold the lock
+func (k *keys) load(id string) (*keyUsage, error) {
+	if u, has := k.cache[id]; has {
+		return u, nil
+	}
+
+	u := &keyUsage{savedAt: time.Now()}
+	err := k.dict.Get(id, &u.item)
+	if err == storer.ErrKeyNotFound {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k.cache[id] = u
+	return u, nil
+}
+
+// save the request count of the key, the caller should hold the lock
+func (k *keys) save(id string, u *keyUsage) error {
+	if u.unsaved == 0 {
+		return nil
+	}
+
+	err := k.store.Update(func(txn storer.Txn) error {
+		dict := k.dict.Txn(txn)
+
+		var item apiKey
+		err := dict.Get(id, &item)
+		if err != nil {
+			return err
+		}
+
+		item.Requests += u.unsaved
+		return dict.Set(id, &item)
+	})
+	if err != nil {
+		return err
+	}
+
+	u.unsaved = 0
+	u.savedAt = time.Now()
+	return nil
+}
+
+// flush saves the request counts of all the keys
+func (k *keys) flush() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	for id, u := range k.cache {
+		err := k.save(id, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle the admin api of "/-/keys", GET to list, POST to create, DELETE "/-/keys/{id}" to revoke
+func (k *keys) handle(ctx kit.GinContext) {
+	if !k.admin(ctx) {
+		apiError(ctx, "invalid Digto-Admin-Key")
+		return
+	}
+
+	switch ctx.Request.Method {
+	case http.MethodGet:
+		list, err := k.list()
+		if err != nil {
+			apiError(ctx, err.Error())
+			return
+		}
+		for i := range list {
+			list[i].Hash = ""
+		}
+		ctx.JSON(http.StatusOK, list)
+
+	case http.MethodPost:
+		maxSubdomains, _ := strconv.Atoi(ctx.Query("max-subdomains"))
+		maxRequests, _ := strconv.Atoi(ctx.Query("max-requests"))
+
+		key, item, err := k.create(ctx.Query("name"), maxSubdomains, maxRequests)
+		if err != nil {
+			apiError(ctx, err.Error())
+			return
+		}
+		item.Hash = ""
+
+		ctx.JSON(http.StatusOK, map[string]interface{}{
+			"key":  key,
+			"info": item,
+		})
+
+	case http.MethodDelete:
+		err := k.revoke(ctx.Param("id"))
+		if err != nil {
+			apiError(ctx, err.Error())
+		}
+
+	default:
+		apiError(ctx, "method not allowed: "+ctx.Request.Method)
+	}
+}
+
+// admin returns true if the request has the correct Digto-Admin-Key
+func (k *keys) admin(ctx kit.GinContext) bool {
+	return k.adminKey != "" &&
+		subtle.ConstantTimeCompare([]byte(authHeader(ctx, "Digto-Admin-Key")), []byte(k.adminKey)) == 1
+}
+
+// keyID returns the id part of the key "{id}.{secret}"
+func keyID(key string) string {
+	return strings.SplitN(key, ".", 2)[0]
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ysmood/kit"
+)
+
+// the upper bounds of the latency histograms in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metricInfo describes a metric family, the order of the list is the order of the output
+var metricInfo = []struct {
+	name string
+	kind string
+	help string
+}{
+	{"digto_requests_total", "counter", "Public requests of each subdomain."},
+	{"digto_api_requests_total", "counter", "Consumer api requests of each subdomain."},
+	{"digto_errors_total", "counter", "Responses with the Digto-Error header of each subdomain."},
+	{"digto_received_bytes_total", "counter", "Body bytes received from the public requests."},
+	{"digto_sent_bytes_total", "counter", "Body bytes sent to the public requests."},
+	{"digto_public_wait_seconds", "histogram", "Time a public request waits until a consumer takes it."},
+	{"digto_consumer_pickup_seconds", "histogram", "Time a consumer waits until it gets a public request."},
+	{"digto_response_seconds", "histogram", "Time from a consumer taking a public request to its response."},
+	{"digto_waitlist_depth", "gauge", "Entries of each waitlist of the proxy."},
+	{"digto_cert_expiry_timestamp_seconds", "gauge", "Unix time when the certificate expires."},
+	{"digto_cert_renewal_failures", "gauge", "Consecutive failed attempts to obtain or renew the certificate."},
+}
+
+// metricsSubdomain can't be used by the consumers, "/metrics" of the api host is the alias of "/-/metrics",
+// so that the default metrics_path of prometheus works
+const metricsSubdomain = "metrics"
+
+// otherSubdomain is the label of the subdomains that are not reserved and have no consumer,
+// so that the hosts sent by the public can't create unlimited series
+const otherSubdomain = "(other)"
+
+// maxSubdomainLabels caps the subdomains that have their own series
+const maxSubdomainLabels = 1000
+
+// subdomainLabelTTL is how long a subdomain keeps its own series after its last consumer request
+const subdomainLabelTTL = time.Hour
+
+// series maps the rendered labels, such as `subdomain="a"`, to the value
+type series map[string]float64
+
+type histogram struct {
+	buckets []float64
+	sum     float64
+	count   float64
+}
+
+// metrics collects the stats of the server and writes them in the prometheus text format
+type metrics struct {
+	lock       sync.Mutex
+	values     map[string]series
+	histograms map[string]map[string]*histogram
+
+	// consumed subdomain -> the time of the last consumer request
+	consumed map[string]time.Time
+	reserved func(subdomain string) bool
+}
+
+func newMetrics(reserved func(subdomain string) bool) *metrics {
+	return &metrics{
+		values:     map[string]series{},
+		histograms: map[string]map[string]*histogram{},
+		consumed:   map[string]time.Time{},
+		reserved:   reserved,
+	}
+}
+
+// consume marks the subdomain has a consumer, so that it has its own series.
+// The subdomains without consumer requests for the subdomainLabelTTL are removed with their series.
+func (m *metrics) consume(subdomain string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, has := m.consumed[subdomain]; !has && len(m.consumed) >= maxSubdomainLabels {
+		for name, t := range m.consumed {
+			if time.Since(t) > subdomainLabelTTL {
+				delete(m.consumed, name)
+				m.remove(name)
+			}
+		}
+		if len(m.consumed) >= maxSubdomainLabels {
+			return
+		}
+	}
+	m.consumed[subdomain] = time.Now()
+}
+
+// remove the series of the subdomain, the caller should hold the lock
+func (m *metrics) remove(subdomain string) {
+	l := label("subdomain", subdomain)
+	for _, s := range m.values {
+		for labels := range s {
+			if strings.Contains(labels, l) {
+				delete(s, labels)
+			}
+		}
+	}
+	for _, hs := range m.histograms {
+		for labels := range hs {
+			if strings.Contains(labels, l) {
+				delete(hs, labels)
+			}
+		}
+	}
+}
+
+// subdomain returns the label of the subdomain, otherSubdomain if it's not reserved and has no consumer
+func (m *metrics) subdomain(subdomain string) string {
+	m.lock.Lock()
+	_, has := m.consumed[subdomain]
+	m.lock.Unlock()
+
+	if has || m.reserved(subdomain) {
+		return label("subdomain", subdomain)
+	}
+	return label("subdomain", otherSubdomain)
+}
+
+func (m *metrics) add(name, labels string, v float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, has := m.values[name]; !has {
+		m.values[name] = series{}
+	}
+	m.values[name][labels] += v
+}
+
+// set replaces all the series of a gauge
+func (m *metrics) set(name string, s series) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.values[name] = s
+}
+
+func (m *metrics) observe(name, subdomain string, d time.Duration) {
+	labels := m.subdomain(subdomain)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, has := m.histograms[name]; !has {
+		m.histograms[name] = map[string]*histogram{}
+	}
+	h, has := m.histograms[name][labels]
+	if !has {
+		h = &histogram{buckets: make([]float64, len(latencyBuckets))}
+		m.histograms[name][labels] = h
+	}
+
+	s := d.Seconds()
+	for i, le := range latencyBuckets {
+		if s <= le {
+			h.buckets[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+// count the finished request
+func (m *metrics) count(e *accessEntry) {
+	labels := m.subdomain(e.Subdomain)
+
+	if e.Error != "" {
+		m.add("digto_errors_total", labels, 1)
+	}
+
+	if e.Kind != "public" {
+		m.add("digto_api_requests_total", labels, 1)
+		return
+	}
+
+	m.add("digto_requests_total", labels, 1)
+	m.add("digto_received_bytes_total", labels, float64(e.BytesIn))
+	if e.BytesOut > 0 {
+		m.add("digto_sent_bytes_total", labels, float64(e.BytesOut))
+	}
+}
+
+// write all the metrics in the prometheus text format
+func (m *metrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, info := range metricInfo {
+		s, hasValues := m.values[info.name]
+		hs, hasHistograms := m.histograms[info.name]
+		if !hasValues && !hasHistograms {
+			continue
+		}
+
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", info.name, info.help, info.name, info.kind)
+
+		for _, labels := range sortedKeys(s) {
+			fmt.Fprintf(w, "%s%s %v\n", info.name, braces(labels), s[labels])
+		}
+
+		for _, labels := range sortedHistogramKeys(hs) {
+			h := hs[labels]
+			for i, le := range latencyBuckets {
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%v\"} %v\n", info.name, labels, le, h.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %v\n", info.name, labels, h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %v\n", info.name, labels, h.sum)
+			fmt.Fprintf(w, "%s_count{%s} %v\n", info.name, labels, h.count)
+		}
+	}
+}
+
+// handle GET "/-/metrics"
+func (m *metrics) handle(ctx kit.GinContext) {
+	ctx.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	ctx.Status(http.StatusOK)
+	m.write(ctx.Writer)
+}
+
+// label renders a label pair with the value escaped
+func label(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func sortedKeys(s series) []string {
+	list := make([]string, 0, len(s))
+	for k := range s {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func sortedHistogramKeys(hs map[string]*histogram) []string {
+	list := make([]string, 0, len(hs))
+	for k := range hs {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ysmood/digto/internal/netutil"
+	"github.com/ysmood/kit"
+	"golang.org/x/net/http2"
+)
+
+// muxProxy holds the multiplexed connections of the consumers. After the protocol switching
+// the server acts as the http2 client of the connection, each public request becomes a stream of it.
+type muxProxy struct {
+	transport *http2.Transport
+	metrics   *metrics
+
+	lock  sync.Mutex
+	conns map[string][]*http2.ClientConn
+}
+
+func newMuxProxy(metrics *metrics) *muxProxy {
+	return &muxProxy{
+		transport: &http2.Transport{AllowHTTP: true},
+		metrics:   metrics,
+		conns:     map[string][]*http2.ClientConn{},
+	}
+}
+
+// hopHeaders are not allowed in http2 requests
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Te",
+}
+
+// handle takes over the consumer connection until it's closed
+func (m *muxProxy) handle(subdomain string, ctx kit.GinContext) {
+	if !netutil.IsUpgrade(ctx.Request) {
+		apiError(ctx, "mux requires the Connection: Upgrade header")
+		return
+	}
+
+	conn, err := hijack(ctx)
+	if err != nil {
+		apiError(ctx, err.Error())
+		return
+	}
+
+	err = switchProtocols(conn, http.Header{
+		"Connection": {"Upgrade"},
+		"Upgrade":    {"digto"},
+	})
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	watched := &watchedConn{Conn: conn, done: make(chan kit.Nil)}
+
+	cc, err := m.transport.NewClientConn(watched)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	m.add(subdomain, cc)
+	<-watched.done
+	m.del(subdomain, cc)
+
+	_ = cc.Close()
+}
+
+// forward the public request via a multiplexed connection of the subdomain, the start is when the public
+// request arrives, returns false if there's no available connection.
+func (m *muxProxy) forward(subdomain string, ctx kit.GinContext, entry *accessEntry, start time.Time) bool {
+	cc := m.pick(subdomain)
+	if cc == nil {
+		return false
+	}
+
+	m.metrics.observe("digto_public_wait_seconds", subdomain, time.Since(start))
+	entry.Wait = milliseconds(time.Since(start))
+	picked := time.Now()
+
+	req := ctx.Request.Clone(ctx.Request.Context())
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = ctx.Request.Host
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+
+	res, err := cc.RoundTrip(req)
+	if err != nil {
+		apiError(ctx, err.Error())
+		return true
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	m.metrics.observe("digto_response_seconds", subdomain, time.Since(picked))
+
+	for k, l := range res.Header {
+		for _, v := range l {
+			ctx.Writer.Header().Add(k, v)
+		}
+	}
+	ctx.Status(res.StatusCode)
+
+	_, err = io.Copy(flushWriter{ctx.Writer}, res.Body)
+	if err != nil {
+		apiError(ctx, err.Error())
+	}
+
+	return true
+}
+
+func (m *muxProxy) pick(subdomain string) *http2.ClientConn {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, cc := range m.conns[subdomain] {
+		if cc.CanTakeNewRequest() {
+			return cc
+		}
+	}
+	return nil
+}
+
+// close all the multiplexed connections
+func (m *muxProxy) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, list := range m.conns {
+		for _, cc := range list {
+			_ = cc.Close()
+		}
+	}
+}
+
+func (m *muxProxy) add(subdomain string, cc *http2.ClientConn) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.conns[subdomain] = append(m.conns[subdomain], cc)
+}
+
+func (m *muxProxy) del(subdomain string, cc *http2.ClientConn) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list := []*http2.ClientConn{}
+	for _, c := range m.conns[subdomain] {
+		if c != cc {
+			list = append(list, c)
+		}
+	}
+
+	if len(list) == 0 {
+		delete(m.conns, subdomain)
+	} else {
+		m.conns[subdomain] = list
+	}
+}
+
+// watchedConn closes the done channel when the connection fails to read
+type watchedConn struct {
+	net.Conn
+	once sync.Once
+	done chan kit.Nil
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.once.Do(func() { close(c.done) })
+	}
+	return n, err
+}
@@ -6,12 +6,31 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/ysmood/digto/internal/netutil"
 	"github.com/ysmood/kit"
+	"github.com/ysmood/storer"
 )
 
 type proxy struct {
+	// inflight is the count of the public requests being handled, keep it the first field for the 64-bit alignment
+	inflight int64
+
 	host         string
+	timeout      time.Duration
+	engine       http.Handler
+	tcp          *tcpProxy
+	mux          *muxProxy
+	reservations *reservations
+	keys         *keys
+	inspector    *inspector
+	queue        *queue
+	metrics      *metrics
+	accessLog    *accessLog
+	domains      *domains
+	cluster      *clusterProxy
 	reqConsumers map[string]map[string]*proxyCtx
 	resConsumers map[string]*proxyCtx
 	reqWaitlist  map[string]map[string]*proxyCtx
@@ -22,9 +41,14 @@ type proxy struct {
 	consumerLeave chan *proxyCtx
 	req           chan *proxyCtx
 	reqLeave      chan *proxyCtx
+	reqClaim      chan *proxyClaim
 	res           chan *proxyCtx
 	resLeave      chan *proxyCtx
 
+	// closing is closed when the server starts to shut down, stop ends the eventLoop
+	closing chan struct{}
+	stop    chan struct{}
+
 	status map[string]interface{}
 }
 
@@ -33,11 +57,37 @@ type proxyCtx struct {
 	id        string
 	ctx       kit.GinContext
 	cancel    context.CancelFunc
+
+	// label of the subdomain for the metrics, it's resolved once so that the eventLoop won't check
+	// the reservations on each update of the status
+	label string
+}
+
+// proxyClaim takes a consumer out of the waitlist, ok receives false if it's already matched
+type proxyClaim struct {
+	ctx *proxyCtx
+	ok  chan bool
 }
 
-func newProxy(host string) *proxy {
+func newProxy(host, tcpHost string, timeout time.Duration, store *storer.Store, engine http.Handler) *proxy {
+	closing := make(chan struct{})
+	reservations := newReservations(store)
+
+	metrics := newMetrics(reservations.reserved)
+
 	return &proxy{
 		host:          host,
+		timeout:       timeout,
+		engine:        engine,
+		tcp:           newTCPProxy(tcpHost, timeout, closing),
+		mux:           newMuxProxy(metrics),
+		reservations:  reservations,
+		keys:          newKeys(store),
+		inspector:     newInspector(store),
+		queue:         newQueue(store, timeout),
+		metrics:       metrics,
+		domains:       newDomains(host, store),
+		cluster:       &clusterProxy{},
 		reqConsumers:  map[string]map[string]*proxyCtx{},
 		resConsumers:  map[string]*proxyCtx{},
 		reqWaitlist:   map[string]map[string]*proxyCtx{},
@@ -47,8 +97,11 @@ func newProxy(host string) *proxy {
 		consumerLeave: make(chan *proxyCtx),
 		req:           make(chan *proxyCtx),
 		reqLeave:      make(chan *proxyCtx),
+		reqClaim:      make(chan *proxyClaim),
 		res:           make(chan *proxyCtx),
 		resLeave:      make(chan *proxyCtx),
+		closing:       closing,
+		stop:          make(chan struct{}),
 		status:        map[string]interface{}{},
 	}
 }
@@ -57,19 +110,135 @@ func (p *proxy) handler(ctx kit.GinContext) {
 	if ctx.Request.Host == p.host {
 		ctx.Status(200)
 
-		subdomain := strings.Trim(ctx.Request.URL.Path, "/")
-		if ctx.Request.Method == http.MethodGet {
-			p.handleReq(subdomain, ctx)
+		subdomain, action := route(ctx.Request.URL.Path)
+
+		key, token := authHeader(ctx, "Digto-Key"), authHeader(ctx, "Digto-Token")
+		if action == "inspect" {
+			key, token = authQuery(ctx, "Digto-Key"), authQuery(ctx, "Digto-Token")
+		}
+
+		entry := p.track(ctx, "api", subdomain)
+		entry.Action = action
+		defer p.finish(entry)
+
+		if subdomain == metricsSubdomain {
+			apiError(ctx, "the subdomain "+metricsSubdomain+" is reserved for the /metrics api")
 			return
 		}
 
-		p.handleRes(subdomain, ctx)
+		if action == "reserve" {
+			if p.cluster.toOwner(ctx) {
+				return
+			}
+			done, err := p.keys.use(key, subdomain)
+			if err != nil {
+				authError(ctx, err)
+				return
+			}
+			defer done()
+			if p.keys.adminKey != "" {
+				entry.Key = keyID(key)
+			}
+			p.reservations.handle(subdomain, ctx)
+			return
+		}
+
+		reserved, done, err := p.auth(subdomain, key, token)
+		if err != nil {
+			authError(ctx, err)
+			return
+		}
+		defer done()
+		if p.keys.adminKey != "" {
+			entry.Key = keyID(key)
+		}
+		p.metrics.consume(subdomain)
+
+		switch {
+		case p.cluster.enabled() && clusterUnsupported[action]:
+			apiError(ctx, "the "+action+" api is not supported in cluster mode")
+		case action == "tcp":
+			p.tcp.handle(subdomain, entry.Key, ctx)
+		case action == "mux":
+			p.mux.handle(subdomain, ctx)
+		case action == "queue":
+			p.queue.handle(subdomain, ctx)
+		case action == "domain":
+			p.domains.handle(subdomain, reserved, ctx)
+		case action == "inspect":
+			p.inspector.handle(subdomain, ctx)
+		case strings.HasPrefix(action, "replay/") && ctx.Request.Method == http.MethodPost:
+			p.replay(subdomain, strings.TrimPrefix(action, "replay/"), ctx)
+		case action != "":
+			apiError(ctx, "unknown action: "+action)
+		case ctx.Request.Method == http.MethodGet:
+			leave := p.cluster.join(subdomain)
+			p.handleReq(subdomain, ctx)
+			leave()
+		default:
+			p.handleRes(subdomain, ctx)
+		}
 		return
 	}
 
 	p.handleConsumer(ctx)
 }
 
+// auth checks the api key and the reservation token of the api request, on the owner node if it's clustered.
+// Call the done when the request ends.
+func (p *proxy) auth(subdomain, key, token string) (reserved bool, done func(), err error) {
+	if handled, reserved, done, err := p.cluster.auth(subdomain, key, token); handled {
+		return reserved, done, err
+	}
+	return p.localAuth(subdomain, key, token)
+}
+
+func (p *proxy) localAuth(subdomain, key, token string) (bool, func(), error) {
+	done, err := p.keys.use(key, subdomain)
+	if err != nil {
+		return false, nil, err
+	}
+
+	reserved, err := p.reservations.check(subdomain, token)
+	if err != nil {
+		done()
+		return false, nil, err
+	}
+	return reserved, done, nil
+}
+
+// authHeader gets the auth value from the header, the secrets are never read from the url
+func authHeader(ctx kit.GinContext, name string) string {
+	return ctx.GetHeader(name)
+}
+
+// authQuery is the same as authHeader, but if the header is not found it takes the value from the query
+// with the same name, so that the inspect page can be opened in the browser. The query is removed from the url,
+// so that it won't be recorded anywhere. Call it before anything reads the query of the ctx.
+func authQuery(ctx kit.GinContext, name string) string {
+	if v := authHeader(ctx, name); v != "" {
+		return v
+	}
+
+	q := ctx.Request.URL.Query()
+	v := q.Get(name)
+	if _, has := q[name]; has {
+		q.Del(name)
+		ctx.Request.URL.RawQuery = q.Encode()
+		ctx.Request.RequestURI = ctx.Request.URL.RequestURI()
+	}
+	return v
+}
+
+// route splits the api path "/{subdomain}/{action}"
+func route(path string) (subdomain, action string) {
+	list := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	if len(list) == 2 {
+		return list[0], list[1]
+	}
+	return list[0], ""
+}
+
 func (p *proxy) eventLoop() {
 	for {
 		select {
@@ -98,6 +267,11 @@ func (p *proxy) eventLoop() {
 		case ctx := <-p.reqLeave:
 			p.del(p.reqWaitlist, ctx.subdomain, ctx.id)
 
+		case claim := <-p.reqClaim:
+			_, has := p.reqWaitlist[claim.ctx.subdomain][claim.ctx.id]
+			p.del(p.reqWaitlist, claim.ctx.subdomain, claim.ctx.id)
+			claim.ok <- has
+
 		case ctx := <-p.reqHeaderDone:
 			p.del(p.reqConsumers, ctx.subdomain, ctx.id)
 			p.resConsumers[ctx.id] = ctx
@@ -120,6 +294,9 @@ func (p *proxy) eventLoop() {
 		case ctx := <-p.consumerLeave:
 			p.del(p.reqConsumers, ctx.subdomain, ctx.id)
 			delete(p.resConsumers, ctx.id)
+
+		case <-p.stop:
+			return
 		}
 
 		p.updateStatus()
@@ -153,7 +330,43 @@ func (p *proxy) del(dict map[string]map[string]*proxyCtx, subdomain, id string)
 	}
 }
 
+// draining returns true after the server starts to shut down
+func (p *proxy) draining() bool {
+	select {
+	case <-p.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait until the in-flight public requests finish or the c is done
+func (p *proxy) wait(c context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&p.inflight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-c.Done():
+			return c.Err()
+		}
+	}
+	return nil
+}
+
 func (p *proxy) handleReq(subdomain string, ctx kit.GinContext) {
+	if p.draining() {
+		apiError(ctx, ErrShuttingDown.Error())
+		return
+	}
+
+	start := time.Now()
+	queued := p.queue.wait(subdomain)
+	if p.queue.deliver(subdomain, ctx) {
+		return
+	}
+
 	wait, cancel := context.WithCancel(ctx.Request.Context())
 
 	c := &proxyCtx{
@@ -161,11 +374,38 @@ func (p *proxy) handleReq(subdomain string, ctx kit.GinContext) {
 		subdomain: subdomain,
 		cancel:    cancel,
 		ctx:       ctx,
+		label:     p.metrics.subdomain(subdomain),
 	}
 
 	p.req <- c
 
-	<-wait.Done()
+	select {
+	case <-wait.Done():
+	case <-queued:
+		// a message is queued, take it unless a live public request has already taken the consumer
+		claim := &proxyClaim{c, make(chan bool, 1)}
+		p.reqClaim <- claim
+		if <-claim.ok {
+			cancel()
+			p.handleReq(subdomain, ctx)
+			return
+		}
+		<-wait.Done()
+	case <-p.closing:
+		// tell the consumer to stop polling unless a public request has already taken it
+		claim := &proxyClaim{c, make(chan bool, 1)}
+		p.reqClaim <- claim
+		if <-claim.ok {
+			cancel()
+			apiError(ctx, ErrShuttingDown.Error())
+			return
+		}
+		<-wait.Done()
+	}
+
+	if ctx.Request.Context().Err() == nil {
+		p.metrics.observe("digto_consumer_pickup_seconds", subdomain, time.Since(start))
+	}
 
 	p.reqLeave <- c
 }
@@ -177,6 +417,19 @@ func (p *proxy) handleRes(subdomain string, ctx kit.GinContext) {
 		return
 	}
 
+	if p.cluster.forwardRes(id, ctx) {
+		return
+	}
+
+	queued, err := p.queue.ack(subdomain, id)
+	if err != nil {
+		apiError(ctx, err.Error())
+		return
+	}
+	if queued {
+		return
+	}
+
 	wait, cancel := context.WithCancel(ctx.Request.Context())
 
 	c := &proxyCtx{
@@ -184,6 +437,7 @@ func (p *proxy) handleRes(subdomain string, ctx kit.GinContext) {
 		subdomain: subdomain,
 		cancel:    cancel,
 		ctx:       ctx,
+		label:     p.metrics.subdomain(subdomain),
 	}
 	p.res <- c
 
@@ -193,19 +447,95 @@ func (p *proxy) handleRes(subdomain string, ctx kit.GinContext) {
 }
 
 func (p *proxy) handleConsumer(ctx kit.GinContext) {
+	atomic.AddInt64(&p.inflight, 1)
+	defer atomic.AddInt64(&p.inflight, -1)
+
+	replayHeader(ctx.Request)
+
+	subdomain := p.domains.subdomain(ctx.Request.Host)
+	id := p.cluster.newID()
+	start := time.Now()
+	forwarded := p.cluster.forwarded(ctx)
+
+	entry := p.track(ctx, "public", subdomain)
+	entry.ID = id
+	defer p.finish(entry)
+
+	rec := p.inspector.start(id, subdomain, ctx)
+	defer p.inspector.end(rec, ctx)
+
+	if !netutil.IsUpgrade(ctx.Request) && (p.queue.push(id, subdomain, ctx) || p.mux.forward(subdomain, ctx, entry, start)) {
+		return
+	}
+
+	if !forwarded {
+		if node := p.cluster.pick(subdomain); node != nil {
+			p.cluster.forward(*node, ctx)
+			return
+		}
+	}
+
 	wait, cancel := context.WithCancel(ctx.Request.Context())
-	subdomain := strings.Replace(ctx.Request.Host, "."+p.host, "", 1)
-	id := randString()
 
 	msg := &proxyCtx{
 		subdomain: subdomain,
 		id:        id,
 		cancel:    cancel,
+		label:     p.metrics.subdomain(subdomain),
 	}
 
 	p.consumer <- msg
 
-	<-wait.Done()
+	recheck, stop := p.cluster.recheck()
+	defer stop()
+	if forwarded {
+		recheck = nil
+	}
+
+	for {
+		select {
+		case <-wait.Done():
+		case <-p.closing:
+			// the sender can retry it later, unless a consumer has already taken it
+			p.consumerLeave <- msg
+			if msg.ctx == nil {
+				cancel()
+				ctx.Header("Retry-After", "10")
+				ctx.Header("Digto-Error", ErrShuttingDown.Error())
+				ctx.AbortWithStatus(http.StatusServiceUnavailable)
+				return
+			}
+			<-wait.Done()
+		case <-recheck:
+			// hand it over if a consumer starts polling another node, unless a consumer has already taken it
+			node := p.cluster.pick(subdomain)
+			if node == nil {
+				continue
+			}
+			p.consumerLeave <- msg
+			if msg.ctx == nil {
+				cancel()
+				p.cluster.forward(*node, ctx)
+				return
+			}
+			<-wait.Done()
+		}
+		break
+	}
+
+	if ctx.Request.Context().Err() != nil {
+		// the public request is gone before the consumer takes it
+		p.consumerLeave <- msg
+		if msg.ctx != nil {
+			apiError(msg.ctx, "the public request is canceled")
+			msg.cancel()
+		}
+		return
+	}
+
+	p.metrics.observe("digto_public_wait_seconds", subdomain, time.Since(start))
+	entry.Wait = milliseconds(time.Since(start))
+	picked := time.Now()
 
 	msg.ctx.Header("Digto-ID", id)
 	msg.ctx.Header("Digto-Method", ctx.Request.Method)
@@ -230,6 +560,8 @@ func (p *proxy) handleConsumer(ctx kit.GinContext) {
 	p.reqHeaderDone <- msg
 	<-wait.Done()
 
+	p.metrics.observe("digto_response_seconds", subdomain, time.Since(picked))
+
 	status := msg.ctx.GetHeader("Digto-Status")
 	if status == "" {
 		status = "200"
@@ -237,6 +569,17 @@ func (p *proxy) handleConsumer(ctx kit.GinContext) {
 	code, _ := strconv.ParseInt(status, 10, 32)
 	ctx.Status(int(code))
 
+	if code == http.StatusSwitchingProtocols {
+		err = tunnel(ctx, msg.ctx, p.closing)
+		if err != nil {
+			apiError(ctx, err.Error())
+			apiError(msg.ctx, err.Error())
+		}
+		msg.cancel()
+		p.consumerLeave <- msg
+		return
+	}
+
 	for k, l := range msg.ctx.Request.Header {
 		if strings.HasPrefix(k, "Digto") {
 			continue
@@ -246,7 +589,7 @@ func (p *proxy) handleConsumer(ctx kit.GinContext) {
 		}
 	}
 
-	_, err = io.Copy(ctx.Writer, msg.ctx.Request.Body)
+	_, err = io.Copy(flushWriter{ctx.Writer}, msg.ctx.Request.Body)
 	if err != nil {
 		apiError(ctx, err.Error())
 		apiError(msg.ctx, err.Error())
@@ -264,4 +607,25 @@ func (p *proxy) updateStatus() {
 		"reqWaitlist":  len(p.reqWaitlist),
 		"resWaitlist":  len(p.resWaitlist),
 	}
+
+	depths := series{}
+	for name, dict := range map[string]map[string]map[string]*proxyCtx{
+		"reqConsumers": p.reqConsumers,
+		"reqWaitlist":  p.reqWaitlist,
+	} {
+		for _, list := range dict {
+			for _, ctx := range list {
+				depths[label("list", name)+","+ctx.label]++
+			}
+		}
+	}
+	for name, dict := range map[string]map[string]*proxyCtx{
+		"resConsumers": p.resConsumers,
+		"resWaitlist":  p.resWaitlist,
+	} {
+		for _, ctx := range dict {
+			depths[label("list", name)+","+ctx.label]++
+		}
+	}
+	p.metrics.set("digto_waitlist_depth", depths)
 }
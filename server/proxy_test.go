@@ -1,13 +1,26 @@
 package server_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/ysmood/digto/server"
+	"github.com/ysmood/digto/server/cert"
+	"github.com/ysmood/digto/server/cluster"
 	"github.com/ysmood/kit"
 )
 
@@ -136,11 +149,759 @@ func TestConcurent(t *testing.T) {
 func TestError(t *testing.T) {
 	dir := "tmp/" + kit.RandString(16)
 
-	_, err := server.New(dir+"/digto.db", "dnspod", "test", "digto.org", "", ":0", "", 2*time.Minute)
-	assert.Error(t, err)
+	s, err := server.New(dir+"/digto.db", "dnspod", "test", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	assert.EqualError(t, s.SetDDNS("nope", "", 0), "invalid ip source: nope")
+	assert.Error(t, s.Serve())
+
+	// the certificate of the dns-01 is obtained after the server starts
+	dir = "tmp/" + kit.RandString(16)
+	s, err = server.New(dir+"/digto.db", "rfc2136", `{"RFC2136_NAMESERVER": "127.0.0.1:53"}`, "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	assert.EqualError(t, s.SetACME(cert.Account{KeyType: "nope"}),
+		"key type not supported: nope, the supported ones are: ec256, ec384, rsa2048, rsa4096, rsa8192")
+	assert.Nil(t, s.SetACME(cert.Account{Email: "a@digto.org", KeyType: "ec256"}))
+
+	dir = "tmp/" + kit.RandString(16)
+	_, err = server.New(dir+"/digto.db", "nope", "test", "digto.org", "", ":0", "", 2*time.Minute)
+	assert.EqualError(t, err, "dns provider not supported: nope, the supported ones are: "+strings.Join(cert.Providers(), ", "))
+
+	_, err = cert.NewProvider("cloudflare", map[string]string{"CF_DNS_API_TOKEN": "test"})
+	assert.Nil(t, err)
+	_, err = cert.NewProvider("route53", map[string]string{"AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "secret"})
+	assert.Nil(t, err)
+
+	dir = "tmp/" + kit.RandString(16)
+	_, err = server.New(dir+"/digto.db", "rfc2136", `{"RFC2136_NAMESERVERS": "127.0.0.1:53"}`, "digto.org", "", ":0", "", 2*time.Minute)
+	assert.EqualError(t, err, "failed to create dns provider rfc2136: unknown dns config key: RFC2136_NAMESERVERS, "+
+		"the supported ones are: RFC2136_NAMESERVER, RFC2136_TSIG_ALGORITHM, RFC2136_TSIG_KEY, RFC2136_TSIG_SECRET")
+
+	dir = "tmp/" + kit.RandString(16)
+	_, err = server.New(dir+"/digto.db", "rfc2136", `{"RFC2136_TSIG_KEY": "digto."}`, "digto.org", "", ":0", "", 2*time.Minute)
+	assert.Contains(t, err.Error(), "failed to create dns provider rfc2136")
+
+	dir = "tmp/" + kit.RandString(16)
+	_, err = server.New(dir+"/digto.db", "rfc2136", "{", "digto.org", "", ":0", "", 2*time.Minute)
+	assert.Contains(t, err.Error(), "invalid dns config")
+
+	dir = "tmp/" + kit.RandString(16)
+	s, err = server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	assert.EqualError(t, s.SetChallenge("nope"), "challenge not supported: nope")
+	assert.Nil(t, s.SetChallenge(cert.HTTP01, "a", "b"))
+}
+
+func TestReserve(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	res := kit.Req(host + "/r/reserve").Post().Host("digto.org").MustResponse()
+	token := res.Header.Get("Digto-Token")
+	assert.NotEmpty(t, token)
+
+	assert.Equal(t,
+		"subdomain is already reserved",
+		kit.Req(host+"/r/reserve").Post().Host("digto.org").MustResponse().Header.Get("Digto-Error"),
+	)
+
+	assert.Equal(t,
+		"invalid Digto-Token for the reserved subdomain",
+		kit.Req(host+"/r").Host("digto.org").Header("Digto-Token", "wrong").MustResponse().Header.Get("Digto-Error"),
+	)
+
+	go func() {
+		kit.Req(host + "/path").Host("r.digto.org").MustDo()
+	}()
+
+	req := kit.Req(host+"/r").Host("digto.org").Header("Digto-Token", token).MustResponse()
+	assert.Equal(t, "/path", req.Header.Get("Digto-URL"))
+
+	assert.Equal(t,
+		"invalid Digto-Token for the reserved subdomain",
+		kit.Req(host+"/r/reserve").Delete().Host("digto.org").MustResponse().Header.Get("Digto-Error"),
+	)
+
+	// the secrets are only read from the query by the inspect page
+	assert.Equal(t,
+		"invalid Digto-Token for the reserved subdomain",
+		kit.Req(host+"/r/reserve").Delete().Host("digto.org").Query("Digto-Token", token).MustResponse().Header.Get("Digto-Error"),
+	)
+	assert.Equal(t,
+		"",
+		kit.Req(host+"/r/inspect").Host("digto.org").Query("Digto-Token", token).MustResponse().Header.Get("Digto-Error"),
+	)
+
+	res = kit.Req(host+"/r/reserve").Delete().Host("digto.org").Header("Digto-Token", token).MustResponse()
+	assert.Equal(t, "", res.Header.Get("Digto-Error"))
+}
+
+func TestReservationTTL(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	s.SetReservationTTL(300 * time.Millisecond)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	token := kit.Req(host + "/r/reserve").Post().Host("digto.org").MustResponse().Header.Get("Digto-Token")
+
+	// the usage keeps it reserved
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		res := kit.Req(host+"/r/inspect").Host("digto.org").Header("Digto-Token", token).MustResponse()
+		assert.Equal(t, "", res.Header.Get("Digto-Error"))
+	}
+	assert.Equal(t,
+		"subdomain is already reserved",
+		kit.Req(host+"/r/reserve").Post().Host("digto.org").MustResponse().Header.Get("Digto-Error"),
+	)
+
+	time.Sleep(400 * time.Millisecond)
+	assert.NotEmpty(t, kit.Req(host+"/r/reserve").Post().Host("digto.org").MustResponse().Header.Get("Digto-Token"))
+}
+
+func TestKeys(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	s.SetAdminKey("admin")
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	assert.Equal(t,
+		"invalid Digto-Admin-Key",
+		kit.Req(host+"/-/keys").Host("digto.org").MustResponse().Header.Get("Digto-Error"),
+	)
+
+	created := kit.Req(host+"/-/keys").Post().Host("digto.org").Header("Digto-Admin-Key", "admin").
+		Query("name", "test", "max-subdomains", "1", "max-requests", "4").MustJSON()
+	key := created.Get("key").String()
+	id := created.Get("info.ID").String()
+
+	list := kit.Req(host+"/-/keys").Host("digto.org").Header("Digto-Admin-Key", "admin").MustJSON()
+	assert.Equal(t, "test", list.Get("0.Name").String())
+	assert.Equal(t, "", list.Get("0.Hash").String())
+
+	assert.Equal(t,
+		"invalid Digto-Key",
+		kit.Req(host+"/a/tcp").Host("digto.org").MustResponse().Header.Get("Digto-Error"),
+	)
+
+	go func() {
+		// hold the subdomain "a"
+		kit.Req(host+"/a/tcp").Host("digto.org").Header("Digto-Key", key, "Connection", "Upgrade").MustDo()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t,
+		"concurrent subdomain quota of the key is exceeded",
+		kit.Req(host+"/b/tcp").Host("digto.org").Header("Digto-Key", key).MustResponse().Header.Get("Digto-Error"),
+	)
+
+	// the rejected request above doesn't use the request quota
+	for i := 0; i < 2; i++ {
+		assert.Equal(t,
+			"",
+			kit.Req(host+"/a/tcp").Host("digto.org").Header("Digto-Key", key).MustResponse().Header.Get("Digto-Error"),
+		)
+	}
+	assert.Equal(t,
+		"",
+		kit.Req(host+"/a/tcp").Host("digto.org").Header("Digto-Key", key).MustResponse().Header.Get("Digto-Error"),
+	)
+	assert.Equal(t,
+		"request quota of the key is exceeded",
+		kit.Req(host+"/a/tcp").Host("digto.org").Header("Digto-Key", key).MustResponse().Header.Get("Digto-Error"),
+	)
 
-	assert.Panics(t, func() {
-		dir = "tmp/" + kit.RandString(16)
-		_, _ = server.New(dir+"/digto.db", "", "test", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.Req(host+"/-/keys/"+id).Delete().Host("digto.org").Header("Digto-Admin-Key", "admin").MustDo()
+	assert.Equal(t,
+		"[]",
+		kit.Req(host+"/-/keys").Host("digto.org").Header("Digto-Admin-Key", "admin").MustString(),
+	)
+}
+
+func TestTCPLimit(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", "127.0.0.1:0", "", 2*time.Minute)
+	kit.E(err)
+	s.SetTCPLimit(2, 0)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	port := func(subdomain string) (string, string) {
+		res := kit.Req(host + "/" + subdomain + "/tcp").Host("digto.org").MustResponse()
+		return res.Header.Get("Digto-Port"), res.Header.Get("Digto-Error")
+	}
+
+	a, _ := port("a")
+	again, _ := port("a")
+	assert.Equal(t, a, again)
+
+	_, errMsg := port("b")
+	assert.Equal(t, "", errMsg)
+
+	_, errMsg = port("c")
+	assert.Equal(t, "no tcp port is available on the server", errMsg)
+}
+
+func TestKeyLease(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	s.SetAdminKey("admin")
+	server.SetKeyLease(s, 300*time.Millisecond)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	key := kit.Req(host+"/-/keys").Post().Host("digto.org").Header("Digto-Admin-Key", "admin").
+		Query("max-subdomains", "1").MustJSON().Get("key").String()
+
+	use := func(subdomain string) string {
+		return kit.Req(host+"/"+subdomain+"/tcp").Host("digto.org").Header("Digto-Key", key).
+			MustResponse().Header.Get("Digto-Error")
+	}
+
+	assert.Equal(t, "", use("a"))
+
+	// the request of "a" is done, but its lease is not
+	assert.Equal(t, "concurrent subdomain quota of the key is exceeded", use("b"))
+
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, "", use("b"))
+
+	// the rejected request doesn't count
+	list := kit.Req(host+"/-/keys").Host("digto.org").Header("Digto-Admin-Key", "admin").MustJSON()
+	assert.Equal(t, int64(2), list.Get("0.Requests").Int())
+}
+
+func TestQueueTimeout(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	server.SetQueueTimeout(s, 300*time.Millisecond)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	kit.Req(host + "/q/queue").Put().Host("digto.org").MustDo()
+	kit.Req(host + "/hook").Post().StringBody("event").Host("q.digto.org").MustDo()
+
+	// the first consumer never responds
+	res := kit.Req(host + "/q").Host("digto.org").MustResponse()
+	id := res.Header.Get("Digto-ID")
+
+	// the waiting consumer gets the message after it expires
+	start := time.Now()
+	res = kit.Req(host + "/q").Host("digto.org").MustResponse()
+	assert.Equal(t, id, res.Header.Get("Digto-ID"))
+	assert.True(t, time.Since(start) > 200*time.Millisecond)
+
+	kit.Req(host+"/q").Post().Host("digto.org").Header("Digto-ID", id).MustDo()
+	state := kit.Req(host + "/q/queue").Host("digto.org").MustJSON()
+	assert.Equal(t, int64(0), state.Get("size").Int())
+}
+
+func TestInspect(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	wait := make(chan kit.Nil)
+	go func() {
+		kit.Req(host + "/path?q=1").Post().Host("ins.digto.org").StringBody("ping").MustDo()
+		wait <- kit.Nil{}
+	}()
+
+	req := kit.Req(host + "/ins").Host("digto.org")
+	kit.Req(host+"/ins").Post().Host("digto.org").StringBody("pong").Header(
+		"Digto-ID", req.MustResponse().Header.Get("Digto-ID"),
+		"Digto-Status", "201",
+	).MustDo()
+
+	<-wait
+
+	list := kit.Req(host+"/ins/inspect").Query("format", "json").Host("digto.org").MustJSON()
+	assert.Equal(t, "POST", list.Get("0.Method").String())
+	assert.Equal(t, "/path?q=1", list.Get("0.URL").String())
+	assert.Equal(t, "cGluZw==", list.Get("0.Body").String())
+	assert.Equal(t, "cG9uZw==", list.Get("0.ResBody").String())
+	assert.Equal(t, int64(201), list.Get("0.Status").Int())
+
+	assert.Contains(t, kit.Req(host+"/ins/inspect").Host("digto.org").MustString(), "/path?q=1")
+}
+
+func TestMetrics(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	wait := make(chan kit.Nil)
+	go func() {
+		kit.Req(host + "/").Post().Host("met.digto.org").StringBody("ping").MustDo()
+		wait <- kit.Nil{}
+	}()
+
+	req := kit.Req(host + "/met").Host("digto.org")
+	kit.Req(host+"/met").Post().Host("digto.org").StringBody("pong!").Header(
+		"Digto-ID", req.MustResponse().Header.Get("Digto-ID"),
+	).MustDo()
+
+	<-wait
+
+	kit.Req(host + "/met/unknown").Host("digto.org").MustDo()
+
+	// no consumer polls it
+	kit.Req(host + "/").Host("random.digto.org").Timeout(100 * time.Millisecond).Do()
+	time.Sleep(100 * time.Millisecond)
+
+	res := kit.Req(host + "/-/metrics").Host("digto.org").MustString()
+	assert.Contains(t, res, "# TYPE digto_requests_total counter\n")
+	assert.Contains(t, res, `digto_requests_total{subdomain="met"} 1`)
+	assert.Contains(t, res, `digto_api_requests_total{subdomain="met"} 3`)
+	assert.Contains(t, res, `digto_errors_total{subdomain="met"} 1`)
+	assert.Contains(t, res, `digto_received_bytes_total{subdomain="met"} 4`)
+	assert.Contains(t, res, `digto_sent_bytes_total{subdomain="met"} 5`)
+	assert.Contains(t, res, `digto_public_wait_seconds_count{subdomain="met"} 1`)
+	assert.Contains(t, res, `digto_response_seconds_bucket{subdomain="met",le="+Inf"} 1`)
+	assert.Contains(t, res, `digto_requests_total{subdomain="(other)"} 1`)
+	assert.NotContains(t, res, "random")
+
+	// the alias for the default metrics_path of prometheus
+	assert.Contains(t, kit.Req(host+"/metrics").Host("digto.org").MustString(), "# TYPE digto_requests_total counter\n")
+	assert.Equal(t,
+		"the subdomain metrics is reserved for the /metrics api",
+		kit.Req(host+"/metrics/reserve").Post().Host("digto.org").MustResponse().Header.Get("Digto-Error"),
+	)
+}
+
+func TestAccessLog(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+
+	buf := bytes.NewBuffer(nil)
+	s.SetAccessLog(buf)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	wait := make(chan kit.Nil)
+	go func() {
+		kit.Req(host + "/a").Post().Host("log.digto.org").StringBody("ping").MustDo()
+		wait <- kit.Nil{}
+	}()
+
+	id := kit.Req(host+"/log").Host("digto.org").Query("Digto-Key", "secret").MustResponse().Header.Get("Digto-ID")
+	kit.Req(host+"/log").Post().Host("digto.org").StringBody("pong!").Header(
+		"Digto-ID", id,
+		"Digto-Status", "201",
+	).MustDo()
+
+	<-wait
+	time.Sleep(100 * time.Millisecond)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 3)
+
+	entries := map[string]kit.JSONResult{}
+	for _, l := range lines {
+		e := kit.JSON(l)
+		entries[e.Get("kind").String()+" "+e.Get("method").String()] = e
+	}
+
+	public := entries["public POST"]
+	assert.Equal(t, "log", public.Get("subdomain").String())
+	assert.Equal(t, id, public.Get("id").String())
+	assert.Equal(t, int64(201), public.Get("status").Int())
+	assert.Equal(t, int64(4), public.Get("bytes_in").Int())
+	assert.Equal(t, int64(5), public.Get("bytes_out").Int())
+	assert.True(t, public.Get("duration_ms").Exists())
+
+	assert.Equal(t, id, entries["api GET"].Get("id").String())
+	assert.Equal(t, "/log?Digto-Key=redacted", entries["api GET"].Get("url").String())
+	assert.NotContains(t, buf.String(), "secret")
+	assert.Equal(t, id, entries["api POST"].Get("id").String())
+}
+
+func TestLocalCA(t *testing.T) {
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+	assert.Equal(t, "the local CA is not enabled", kit.Req(host+"/-/ca").Host("digto.org").MustResponse().Header.Get("Digto-Error"))
+	assert.Equal(t, "the certificate is not enabled", kit.Req(host+"/-/cert").Host("digto.org").MustResponse().Header.Get("Digto-Error"))
+
+	s, err = server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	kit.E(s.SetChallenge(cert.LocalCA))
+
+	go func() { kit.E(s.Serve()) }()
+
+	host = "http://" + s.GetServer().Listener.Addr().String()
+	assert.Contains(t, kit.Req(host+"/-/ca").Host("digto.org").MustString(), "BEGIN CERTIFICATE")
+
+	status := kit.Req(host + "/-/cert").Host("digto.org").MustJSON()
+	assert.Equal(t, cert.LocalCA, status.Get("Challenge").String())
+	assert.True(t, status.Get("NotAfter").Time().After(time.Now()))
+	assert.Equal(t, "", status.Get("LastError").String())
+}
+
+func TestCustomDomain(t *testing.T) {
+	server.SetLookupCNAME(func(name string) (string, error) {
+		return map[string]string{"example.com": "a.digto.org.", "other.com": "x.com."}[name], nil
+	})
+
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+	api := func(method, path, token string) *kit.ReqContext {
+		return kit.Req(host+path).Method(method).Host("digto.org").Header("Digto-Token", token)
+	}
+
+	assert.Equal(t,
+		"reserve the subdomain before adding a custom domain",
+		api("POST", "/a/domain?name=example.com", "").MustResponse().Header.Get("Digto-Error"),
+	)
+
+	token := api("POST", "/a/reserve", "").MustString()
+
+	assert.Equal(t,
+		"the CNAME of other.com must be a.digto.org",
+		api("POST", "/a/domain?name=other.com", token).MustResponse().Header.Get("Digto-Error"),
+	)
+	assert.Equal(t,
+		"invalid domain: b.digto.org",
+		api("POST", "/a/domain?name=b.digto.org", token).MustResponse().Header.Get("Digto-Error"),
+	)
+
+	assert.Equal(t, "example.com", api("POST", "/a/domain?name=example.com", token).MustJSON().Get("Name").String())
+	assert.Equal(t, "a", api("GET", "/a/domain", token).MustJSON().Get("0.Subdomain").String())
+
+	wait := make(chan string)
+	go func() {
+		wait <- kit.Req(host + "/path").Host("example.com").MustString()
+	}()
+
+	req := api("GET", "/a", token)
+	assert.Equal(t, "/path", req.MustResponse().Header.Get("Digto-URL"))
+	api("POST", "/a", token).Header("Digto-ID", req.MustResponse().Header.Get("Digto-ID")).StringBody("ok").MustDo()
+	assert.Equal(t, "ok", <-wait)
+
+	api("DELETE", "/a/domain?name=example.com", token).MustDo()
+	assert.Len(t, api("GET", "/a/domain", token).MustJSON().Array(), 0)
+}
+
+func TestCustomDomainCert(t *testing.T) {
+	// the CNAME of example.org only points to the subdomain when it's added
+	var lookups int32
+	server.SetLookupCNAME(func(name string) (string, error) {
+		if name == "example.org" && atomic.AddInt32(&lookups, 1) > 1 {
+			return "x.com.", nil
+		}
+		return "a.digto.org.", nil
 	})
+
+	s, err := server.New("tmp/"+kit.RandString(16)+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	kit.E(s.SetChallenge(cert.LocalCA))
+
+	go func() { kit.E(s.Serve()) }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+	api := func(method, path, token string) *kit.ReqContext {
+		return kit.Req(host+path).Method(method).Host("digto.org").Header("Digto-Token", token)
+	}
+	token := api("POST", "/a/reserve", "").MustString()
+
+	// the certificate is obtained in background after the domain is added
+	api("POST", "/a/domain?name=example.com", token).MustDo()
+	var crt *tls.Certificate
+	for i := 0; i < 100 && crt == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		crt = server.GetDomainCert(s, "example.com")
+	}
+	assert.NotNil(t, crt)
+	assert.Contains(t, crt.Leaf.DNSNames, "example.com")
+
+	api("DELETE", "/a/domain?name=example.com", token).MustDo()
+	assert.Nil(t, server.GetDomainCert(s, "example.com"))
+
+	// the CNAME is verified again before the certificate is updated
+	api("POST", "/a/domain?name=example.org", token).MustDo()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "the CNAME of example.org must be a.digto.org", server.DomainCertStatus(s, "example.org").LastError)
+}
+
+func TestConfig(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+	kit.E(kit.OutputFile(dir+"/digto.yaml", `
+host: digto.org
+db_path: `+dir+`/digto.db
+http_addr: 127.0.0.1:0
+https_addr: 127.0.0.1:0
+timeout: 1m
+dns_config: {}
+acme:
+  email: a@digto.org
+`, nil))
+
+	c, err := server.LoadConfig(dir + "/digto.yaml")
+	kit.E(err)
+	assert.Equal(t, "digto.org", c.Host)
+	assert.Equal(t, server.Duration(time.Minute), c.Timeout)
+	assert.Equal(t, "a@digto.org", c.ACME.Email)
+	assert.Equal(t, "rsa2048", c.ACME.KeyType)
+	assert.Equal(t, 100, c.MaxTCPPorts)
+	assert.Equal(t, ":443", server.DefaultConfig().HTTPSAddr)
+	assert.Equal(t, 0, server.DefaultConfig().MaxTCPPorts)
+	assert.Equal(t, server.Duration(0), server.DefaultConfig().DDNSInterval)
+
+	kit.E(os.Setenv("DIGTO_ACME_EMAIL", "b@digto.org"))
+	kit.E(os.Setenv("DIGTO_CERT_SUBDOMAINS", "a,b"))
+	defer func() { _ = os.Unsetenv("DIGTO_ACME_EMAIL") }()
+	defer func() { _ = os.Unsetenv("DIGTO_CERT_SUBDOMAINS") }()
+	kit.E(c.LoadEnv())
+	assert.Equal(t, "b@digto.org", c.ACME.Email)
+	assert.Equal(t, []string{"a", "b"}, c.CertSubdomains)
+
+	s, err := server.NewWithConfig(c)
+	kit.E(err)
+	go func() { kit.E(s.Serve()) }()
+	host := "http://" + s.GetServer().Listener.Addr().String()
+	assert.Regexp(t, `Digto`, kit.Req(host).Host("digto.org").MustString())
+
+	kit.E(kit.OutputFile(dir+"/digto.json", `{"host": "digto.org", "timeuot": "1m"}`, nil))
+	_, err = server.LoadConfig(dir + "/digto.json")
+	assert.Contains(t, err.Error(), `unknown field "timeuot"`)
+
+	_, err = server.LoadConfig("digto.toml")
+	assert.EqualError(t, err, "toml config is not supported: digto.toml, convert it to yaml or json")
+
+	_, err = server.LoadConfig("digto.ini")
+	assert.EqualError(t, err, "config format not supported: digto.ini, use .yaml, .yml or .json")
+
+	c = server.DefaultConfig()
+	c.Challenge = "nope"
+	c.IPv6 = "nope"
+	assert.EqualError(t, c.Validate(), "invalid config: host is required; challenge not supported: nope; invalid ip source: nope")
+}
+
+func TestShutdown(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+
+	served := make(chan error)
+	go func() { served <- s.Serve() }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	body := make(chan string)
+	go func() {
+		body <- kit.Req(host + "/").Post().Host("a.digto.org").MustString()
+	}()
+
+	// read the body so that the consumer can respond via the same connection after the listener is closed
+	res := kit.Req(host + "/a").Host("digto.org").MustResponse()
+	id := res.Header.Get("Digto-ID")
+	_, err = ioutil.ReadAll(res.Body)
+	kit.E(err)
+
+	polling := make(chan string)
+	go func() {
+		polling <- kit.Req(host + "/b").Host("digto.org").MustResponse().Header.Get("Digto-Error")
+	}()
+
+	// a websocket like tunnel
+	rawReq := func(req string) *bufio.Reader {
+		conn, err := net.Dial("tcp", s.GetServer().Listener.Addr().String())
+		kit.E(err)
+		_, err = conn.Write([]byte(req))
+		kit.E(err)
+		return bufio.NewReader(conn)
+	}
+	public := make(chan *bufio.Reader)
+	go func() {
+		public <- rawReq("GET / HTTP/1.1\r\nHost: t.digto.org\r\nConnection: Upgrade\r\nUpgrade: ws\r\n\r\n")
+	}()
+	tid := kit.Req(host + "/t").Host("digto.org").MustResponse().Header.Get("Digto-ID")
+	consumer := rawReq(fmt.Sprintf("POST /t HTTP/1.1\r\nHost: digto.org\r\nDigto-ID: %s\r\n"+
+		"Digto-Status: 101\r\nConnection: Upgrade\r\nUpgrade: digto\r\nContent-Length: 0\r\n\r\n", tid))
+	tunnel := <-public
+	for _, r := range []*bufio.Reader{tunnel, consumer} {
+		res, err := http.ReadResponse(r, nil)
+		kit.E(err)
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// the idle consumer is told to stop, the tunnel is closed, the in-flight request can still finish
+	assert.Equal(t, "the server is shutting down", <-polling)
+
+	_, err = tunnel.ReadByte()
+	assert.NotNil(t, err)
+
+	kit.Req(host+"/a").Post().Host("digto.org").StringBody("done").Header("Digto-ID", id).MustDo()
+
+	assert.Equal(t, "done", <-body)
+	assert.Nil(t, <-shutdown)
+	assert.Nil(t, <-served)
+
+	// new connections are refused, it's safe to shut down again
+	_, err = net.Dial("tcp", s.GetServer().Listener.Addr().String())
+	assert.NotNil(t, err)
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	s, err := server.New(dir+"/digto.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+
+	served := make(chan error)
+	go func() { served <- s.Serve() }()
+
+	host := "http://" + s.GetServer().Listener.Addr().String()
+
+	public := make(chan error)
+	go func() {
+		_, err := kit.Req(host + "/").Host("a.digto.org").Response()
+		public <- err
+	}()
+
+	// the consumer takes the request but never responds
+	kit.Req(host + "/a").Host("digto.org").MustDo()
+
+	c, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// the connections are closed, the handlers return before the database is closed
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(c))
+	assert.NotNil(t, <-public)
+	assert.Nil(t, <-served)
+}
+
+func TestCluster(t *testing.T) {
+	dir := "tmp/" + kit.RandString(16)
+
+	a, err := server.New(dir+"/a.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	hostA := "http://" + a.GetServer().Listener.Addr().String()
+	a.SetCluster(cluster.Node{Name: "a", URL: hostA}, "secret", cluster.NewMemory())
+	go func() { kit.E(a.Serve()) }()
+
+	b, err := server.New(dir+"/b.db", "", "", "digto.org", "", ":0", "", 2*time.Minute)
+	kit.E(err)
+	hostB := "http://" + b.GetServer().Listener.Addr().String()
+	b.SetCluster(cluster.Node{Name: "b", URL: hostB}, "secret", cluster.NewClient(hostA, "digto.org", "secret"))
+	go func() { kit.E(b.Serve()) }()
+
+	type consumed struct {
+		id, url, body string
+	}
+	consume := func() chan consumed {
+		c := make(chan consumed)
+		go func() {
+			res := kit.Req(hostB + "/c").Host("digto.org").MustResponse()
+			body, err := ioutil.ReadAll(res.Body)
+			kit.E(err)
+			c <- consumed{res.Header.Get("Digto-ID"), res.Header.Get("Digto-URL"), string(body)}
+		}()
+		return c
+	}
+	public := func() chan string {
+		c := make(chan string)
+		go func() {
+			c <- kit.Req(hostA + "/p").Post().Host("c.digto.org").StringBody("ping").MustString()
+		}()
+		return c
+	}
+
+	// the consumer polls b, the public request arrives at a, the response is sent to a
+	polling := consume()
+	time.Sleep(100 * time.Millisecond)
+	res := public()
+
+	req := <-polling
+	assert.Regexp(t, `^b\.`, req.id)
+	assert.Equal(t, "/p", req.url)
+	assert.Equal(t, "ping", req.body)
+
+	kit.Req(hostA+"/c").Post().Host("digto.org").StringBody("pong").Header("Digto-ID", req.id).MustDo()
+	assert.Equal(t, "pong", <-res)
+
+	// the public request waits on a until the consumer polls b
+	res = public()
+	time.Sleep(100 * time.Millisecond)
+	req = <-consume()
+	assert.Equal(t, "ping", req.body)
+
+	kit.Req(hostB+"/c").Post().Host("digto.org").StringBody("pong").Header("Digto-ID", req.id).MustDo()
+	assert.Equal(t, "pong", <-res)
+
+	assert.Equal(t,
+		"unknown cluster node: x",
+		kit.Req(hostA+"/c").Post().Host("digto.org").Header("Digto-ID", "x.id").MustResponse().Header.Get("Digto-Error"),
+	)
+
+	// the reservations are kept by a, the owner node
+	token := kit.Req(hostB + "/r/reserve").Post().Host("digto.org").MustResponse().Header.Get("Digto-Token")
+	assert.NotEmpty(t, token)
+	for _, host := range []string{hostA, hostB} {
+		assert.Equal(t,
+			"invalid Digto-Token for the reserved subdomain",
+			kit.Req(host+"/r/inspect").Host("digto.org").MustResponse().Header.Get("Digto-Error"),
+		)
+		assert.Equal(t,
+			"",
+			kit.Req(host+"/r/inspect").Host("digto.org").Header("Digto-Token", token).MustResponse().Header.Get("Digto-Error"),
+		)
+		assert.Equal(t,
+			"the queue api is not supported in cluster mode",
+			kit.Req(host+"/q/queue").Post().Host("digto.org").MustResponse().Header.Get("Digto-Error"),
+		)
+	}
 }
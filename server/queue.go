@@ -0,0 +1,370 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ysmood/kit"
+	"github.com/ysmood/storer"
+)
+
+// the max bytes of the body of a queued request
+const queueBodyLimit = 10 * 1024 * 1024
+
+// the max queued requests of each subdomain
+const queueSize = 1000
+
+// ErrQueueFull ...
+var ErrQueueFull = errors.New("the queue of the subdomain is full")
+
+// ErrQueueBodyTooLarge ...
+var ErrQueueBodyTooLarge = errors.New("the request body is too large to be queued")
+
+type queueSetting struct {
+	// Status to respond the public requests after they are queued
+	Status int
+}
+
+// message is a queued public request
+type message struct {
+	ID        string
+	Method    string
+	URL       string
+	Host      string
+	Header    http.Header
+	Body      []byte
+	CreatedAt time.Time
+}
+
+// queue stores the public requests of the subdomains in durable mode, and delivers them to the consumers later.
+// A message is only removed after the consumer responds it, or it will be redelivered after the timeout.
+type queue struct {
+	store    *storer.Store
+	settings *storer.Map
+	messages *storer.Map
+	lists    *storer.Map
+	timeout  time.Duration
+
+	lock sync.Mutex
+	// inflight the messages being delivered, they are re-queued when the timers fire
+	inflight map[string]*time.Timer
+	signals  map[string]chan kit.Nil
+}
+
+func newQueue(store *storer.Store, timeout time.Duration) *queue {
+	return &queue{
+		store:    store,
+		settings: store.MapWithName("queue-settings", &queueSetting{}),
+		messages: store.MapWithName("queue-messages", &message{}),
+		lists:    store.MapWithName("queue-lists", &ring{}),
+		timeout:  timeout,
+		inflight: map[string]*time.Timer{},
+		signals:  map[string]chan kit.Nil{},
+	}
+}
+
+// setting returns nil if the durable mode of the subdomain is off
+func (q *queue) setting(subdomain string) (*queueSetting, error) {
+	var s queueSetting
+	err := q.settings.Get(subdomain, &s)
+	if err == storer.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// push stores the public request if the subdomain is in durable mode and responds the configured status,
+// returns false if the request is not handled
+func (q *queue) push(id, subdomain string, ctx kit.GinContext) bool {
+	s, err := q.setting(subdomain)
+	if err != nil {
+		apiError(ctx, err.Error())
+		return true
+	}
+	if s == nil {
+		return false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, queueBodyLimit+1))
+	if err != nil {
+		apiError(ctx, err.Error())
+		return true
+	}
+	if len(body) > queueBodyLimit {
+		apiError(ctx, ErrQueueBodyTooLarge.Error())
+		return true
+	}
+
+	msg := &message{
+		ID:        id,
+		Method:    ctx.Request.Method,
+		URL:       ctx.Request.URL.String(),
+		Host:      ctx.Request.Host,
+		Header:    ctx.Request.Header.Clone(),
+		Body:      body,
+		CreatedAt: time.Now(),
+	}
+
+	err = q.store.Update(func(txn storer.Txn) error {
+		lists := q.lists.Txn(txn)
+
+		var r ring
+		err := lists.Get(subdomain, &r)
+		if err != nil && err != storer.ErrKeyNotFound {
+			return err
+		}
+		if len(r.IDs) >= queueSize {
+			return ErrQueueFull
+		}
+		r.IDs = append(r.IDs, id)
+
+		err = q.messages.Txn(txn).Set(recordKey(subdomain, id), msg)
+		if err != nil {
+			return err
+		}
+		return lists.Set(subdomain, &r)
+	})
+	if err != nil {
+		apiError(ctx, err.Error())
+		return true
+	}
+
+	q.signal(subdomain)
+
+	ctx.Header("Digto-ID", id)
+	ctx.Status(s.Status)
+	return true
+}
+
+// deliver responds the oldest message of the subdomain to the consumer the same way as a live public request,
+// returns false if there's nothing to deliver
+func (q *queue) deliver(subdomain string, ctx kit.GinContext) bool {
+	msg, err := q.next(subdomain)
+	if err != nil {
+		apiError(ctx, err.Error())
+		return true
+	}
+	if msg == nil {
+		return false
+	}
+
+	ctx.Header("Digto-ID", msg.ID)
+	ctx.Header("Digto-Method", msg.Method)
+	ctx.Header("Digto-URL", msg.URL)
+
+	for k, l := range msg.Header {
+		for _, v := range l {
+			ctx.Writer.Header().Add(k, v)
+		}
+	}
+	ctx.Writer.Header().Add("Host", msg.Host)
+
+	_, _ = ctx.Writer.Write(msg.Body)
+	return true
+}
+
+// next returns the oldest message that is not being delivered
+func (q *queue) next(subdomain string) (*message, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var msg *message
+	err := q.store.View(func(txn storer.Txn) error {
+		var r ring
+		err := q.lists.Txn(txn).Get(subdomain, &r)
+		if err == storer.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, id := range r.IDs {
+			key := recordKey(subdomain, id)
+			if _, has := q.inflight[key]; has {
+				continue
+			}
+
+			var m message
+			err = q.messages.Txn(txn).Get(key, &m)
+			if err != nil {
+				return err
+			}
+			var t *time.Timer
+			t = time.AfterFunc(q.timeout, func() { q.expire(subdomain, key, t) })
+			q.inflight[key] = t
+			msg = &m
+			return nil
+		}
+		return nil
+	})
+	return msg, err
+}
+
+// expire re-queues the message that is not responded in time, and wakes the waiting consumers
+func (q *queue) expire(subdomain, key string, t *time.Timer) {
+	q.lock.Lock()
+	if q.inflight[key] != t {
+		q.lock.Unlock()
+		return
+	}
+	delete(q.inflight, key)
+	q.lock.Unlock()
+
+	q.signal(subdomain)
+}
+
+// ack removes the message after the consumer responds it, returns false if the id is not a queued message
+func (q *queue) ack(subdomain, id string) (bool, error) {
+	key := recordKey(subdomain, id)
+
+	q.lock.Lock()
+	t, inflight := q.inflight[key]
+	if inflight {
+		t.Stop()
+		delete(q.inflight, key)
+	}
+	q.lock.Unlock()
+
+	// a late response of an expired message can still ack it, the rest are live public requests
+	if !inflight {
+		size, err := q.size(subdomain)
+		if err != nil || size == 0 {
+			return false, err
+		}
+	}
+
+	found := false
+	err := q.store.Update(func(txn storer.Txn) error {
+		messages := q.messages.Txn(txn)
+		lists := q.lists.Txn(txn)
+
+		var m message
+		err := messages.Get(key, &m)
+		if err == storer.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+
+		err = messages.Del(key)
+		if err != nil {
+			return err
+		}
+
+		var r ring
+		err = lists.Get(subdomain, &r)
+		if err != nil {
+			return err
+		}
+		for i, v := range r.IDs {
+			if v == id {
+				r.IDs = append(r.IDs[:i], r.IDs[i+1:]...)
+				break
+			}
+		}
+		if len(r.IDs) == 0 {
+			return lists.Del(subdomain)
+		}
+		return lists.Set(subdomain, &r)
+	})
+	return found, err
+}
+
+// size returns the count of the queued messages of the subdomain
+func (q *queue) size(subdomain string) (int, error) {
+	var r ring
+	err := q.lists.Get(subdomain, &r)
+	if err == storer.ErrKeyNotFound {
+		return 0, nil
+	}
+	return len(r.IDs), err
+}
+
+// wait returns a channel that will be closed when a new message of the subdomain is queued,
+// returns nil if the subdomain is not in durable mode
+func (q *queue) wait(subdomain string) <-chan kit.Nil {
+	if s, err := q.setting(subdomain); err != nil || s == nil {
+		return nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	ch, has := q.signals[subdomain]
+	if !has {
+		ch = make(chan kit.Nil)
+		q.signals[subdomain] = ch
+	}
+	return ch
+}
+
+func (q *queue) signal(subdomain string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if ch, has := q.signals[subdomain]; has {
+		close(ch)
+		delete(q.signals, subdomain)
+	}
+}
+
+// handle PUT to enable the durable mode with the "status" query, default status is 202,
+// DELETE to disable it, the queued messages will still be delivered. GET to get the state.
+func (q *queue) handle(subdomain string, ctx kit.GinContext) {
+	switch ctx.Request.Method {
+	case http.MethodGet:
+		s, err := q.setting(subdomain)
+		if err != nil {
+			apiError(ctx, err.Error())
+			return
+		}
+		size, err := q.size(subdomain)
+		if err != nil {
+			apiError(ctx, err.Error())
+			return
+		}
+
+		state := gin.H{"enabled": s != nil, "size": size}
+		if s != nil {
+			state["status"] = s.Status
+		}
+		ctx.JSON(http.StatusOK, state)
+
+	case http.MethodPut:
+		status := http.StatusAccepted
+		if v := ctx.Query("status"); v != "" {
+			var err error
+			status, err = strconv.Atoi(v)
+			if err != nil || status < 200 || status > 599 {
+				apiError(ctx, "invalid status: "+v)
+				return
+			}
+		}
+
+		err := q.settings.Set(subdomain, &queueSetting{Status: status})
+		if err != nil {
+			apiError(ctx, err.Error())
+		}
+
+	case http.MethodDelete:
+		err := q.settings.Del(subdomain)
+		if err != nil && err != storer.ErrKeyNotFound {
+			apiError(ctx, err.Error())
+		}
+
+	default:
+		apiError(ctx, "method not allowed: "+ctx.Request.Method)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"github.com/ysmood/kit"
+	"github.com/ysmood/storer"
+)
+
+// replay re-delivers a captured request to the current consumer of the subdomain,
+// then responds what the consumer responds. The replayed request has the "Digto-Replay: {id}" header.
+func (p *proxy) replay(subdomain, id string, ctx kit.GinContext) {
+	rec, err := p.inspector.get(subdomain, id)
+	if err == storer.ErrKeyNotFound {
+		apiError(ctx, "record not found: "+id)
+		return
+	}
+	if err != nil {
+		apiError(ctx, err.Error())
+		return
+	}
+	if rec.BodyTruncated {
+		apiError(ctx, "the body of the record is not fully captured, it can't be replayed")
+		return
+	}
+
+	c := context.WithValue(ctx.Request.Context(), replayKey{}, rec.ID)
+	req, err := http.NewRequestWithContext(c, rec.Method, rec.URL, bytes.NewReader(rec.Body))
+	if err != nil {
+		apiError(ctx, err.Error())
+		return
+	}
+	req.Header = rec.Header.Clone()
+	req.Host = rec.Host
+	req.RequestURI = rec.URL
+	req.RemoteAddr = ctx.Request.RemoteAddr
+
+	p.engine.ServeHTTP(&replayWriter{w: ctx.Writer}, req)
+}
+
+// replayKey marks the replayed requests, so that the public can't forge the Digto-Replay header
+type replayKey struct{}
+
+// replayHeader sets the "Digto-Replay: {id}" header if the request comes from the replay api, or removes it
+func replayHeader(req *http.Request) {
+	req.Header.Del("Digto-Replay")
+	if id, ok := req.Context().Value(replayKey{}).(string); ok {
+		req.Header.Set("Digto-Replay", id)
+	}
+}
+
+// replayWriter streams the replayed response to the api request, only the status, the headers and the body
+// are passed through, the connection of the api request can't be hijacked by the replayed one
+type replayWriter struct {
+	w http.ResponseWriter
+}
+
+func (w *replayWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+func (w *replayWriter) WriteHeader(code int) {
+	w.w.WriteHeader(code)
+}
+
+func (w *replayWriter) Write(data []byte) (int, error) {
+	return w.w.Write(data)
+}
+
+func (w *replayWriter) Flush() {
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ysmood/kit"
+	"github.com/ysmood/storer"
+)
+
+// ErrReserved ...
+var ErrReserved = errors.New("subdomain is already reserved")
+
+// ErrInvalidToken ...
+var ErrInvalidToken = errors.New("invalid Digto-Token for the reserved subdomain")
+
+type reservation struct {
+	// TokenHash the sha256 of the token, the token itself is never stored
+	TokenHash string
+
+	// UsedAt is when the subdomain is reserved or last used with the token
+	UsedAt time.Time
+}
+
+// reservations claims subdomains with secret tokens, only the token owner can consume a reserved subdomain
+type reservations struct {
+	store *storer.Store
+	dict  *storer.Map
+
+	// ttl releases the reservations that are not used for the duration, 0 means they never expire
+	ttl time.Duration
+}
+
+func newReservations(store *storer.Store) *reservations {
+	return &reservations{
+		store: store,
+		dict:  store.MapWithName("reservations", &reservation{}),
+	}
+}
+
+// reserve the subdomain, returns the token to use it
+func (r *reservations) reserve(subdomain string) (string, error) {
+	token := randString() + randString()
+
+	return token, r.store.Update(func(txn storer.Txn) error {
+		dict := r.dict.Txn(txn)
+
+		var item reservation
+		err := dict.Get(subdomain, &item)
+		if err == nil && !r.expired(item) {
+			return ErrReserved
+		}
+		if err != nil && err != storer.ErrKeyNotFound {
+			return err
+		}
+
+		return dict.Set(subdomain, &reservation{TokenHash: hashToken(token), UsedAt: time.Now()})
+	})
+}
+
+// release the reservation of the subdomain
+func (r *reservations) release(subdomain, token string) error {
+	return r.store.Update(func(txn storer.Txn) error {
+		dict := r.dict.Txn(txn)
+
+		_, err := r.verify(dict, subdomain, token)
+		if err != nil {
+			return err
+		}
+
+		return dict.Del(subdomain)
+	})
+}
+
+// check returns error if the subdomain is reserved and the token doesn't match, reserved is true if it's reserved.
+// If the ttl is set, the usage time of the reservation is refreshed at most every tenth of the ttl.
+func (r *reservations) check(subdomain, token string) (reserved bool, err error) {
+	var item *reservation
+	err = r.store.View(func(txn storer.Txn) error {
+		var err error
+		item, err = r.verify(r.dict.Txn(txn), subdomain, token)
+		return err
+	})
+	if err != nil || item == nil {
+		return false, err
+	}
+	if r.ttl == 0 || time.Since(item.UsedAt) < r.ttl/10 {
+		return true, nil
+	}
+
+	return true, r.store.Update(func(txn storer.Txn) error {
+		dict := r.dict.Txn(txn)
+
+		item, err := r.verify(dict, subdomain, token)
+		if err != nil || item == nil {
+			return err
+		}
+
+		item.UsedAt = time.Now()
+		return dict.Set(subdomain, item)
+	})
+}
+
+// reserved returns true if the subdomain is reserved
+func (r *reservations) reserved(subdomain string) bool {
+	var item reservation
+	return r.dict.Get(subdomain, &item) == nil && !r.expired(item)
+}
+
+// verify returns the reservation of the subdomain if the token matches, nil if it's not reserved
+func (r *reservations) verify(dict *storer.MapTxn, subdomain, token string) (*reservation, error) {
+	var item reservation
+	err := dict.Get(subdomain, &item)
+	if err == storer.ErrKeyNotFound || (err == nil && r.expired(item)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(item.TokenHash), []byte(hashToken(token))) != 1 {
+		return nil, ErrInvalidToken
+	}
+	return &item, nil
+}
+
+// expired returns true if the reservation is not used within the ttl,
+// the ones reserved before the ttl is supported have no usage time, the ttl starts after they are used once
+func (r *reservations) expired(item reservation) bool {
+	return r.ttl > 0 && !item.UsedAt.IsZero() && time.Since(item.UsedAt) > r.ttl
+}
+
+// handle POST to reserve, DELETE to release
+func (r *reservations) handle(subdomain string, ctx kit.GinContext) {
+	switch ctx.Request.Method {
+	case http.MethodPost:
+		token, err := r.reserve(subdomain)
+		if err != nil {
+			apiError(ctx, err.Error())
+			return
+		}
+		ctx.Header("Digto-Token", token)
+		ctx.String(http.StatusOK, token)
+
+	case http.MethodDelete:
+		err := r.release(subdomain, authHeader(ctx, "Digto-Token"))
+		if err != nil {
+			apiError(ctx, err.Error())
+		}
+
+	default:
+		apiError(ctx, "method not allowed: "+ctx.Request.Method)
+	}
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
@@ -1,77 +1,239 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-acme/lego/v3/challenge/tlsalpn01"
 	"github.com/ysmood/digto/server/cert"
+	"github.com/ysmood/digto/server/cluster"
+	"github.com/ysmood/digto/server/ddns"
 	"github.com/ysmood/kit"
 	"github.com/ysmood/storer"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// ErrNoCert ...
+var ErrNoCert = errors.New("the certificate is not ready")
+
+// ErrShuttingDown ...
+var ErrShuttingDown = errors.New("the server is shutting down")
+
+// ErrHandlersRunning ...
+var ErrHandlersRunning = errors.New("the handlers are still running after the shutdown, the database is left open")
+
 // Context ...
 type Context struct {
 	host          string
 	cert          *cert.Context
+	ddns          *ddns.Watcher
+	ddnsInterval  time.Duration
+	caDirURL      string
+	certCache     *storer.Value
+	caCache       *storer.Value
+	accountCache  *storer.Value
 	engine        *gin.Engine
 	httpListener  net.Listener
 	httpsListener net.Listener
+	srv           *http.Server
+	tlsSrv        *http.Server
+	done          chan struct{}
 	timeout       time.Duration
 	proxy         *proxy
 	store         *storer.Store
 	reqCounter    *storer.Value
+	account       cert.Account
+	domainCerts   map[string]*cert.Context
+	// domainUpdating the custom domains whose certificates are being updated
+	domainUpdating map[string]bool
+	domainLock     sync.Mutex
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	// handlers is the count of the running http handlers, including the hijacked ones
+	handlers sync.WaitGroup
 
 	onError func(error)
 }
 
-// New ...
+// New creates the server with the DefaultConfig and the args, use NewWithConfig for the other options
 func New(dbPath, dnsProvider, dnsConfig, host, caDirURL, httpAddr, httpsAddr string, timeout time.Duration) (*Context, error) {
-	store := storer.New(dbPath)
+	dns, err := cert.ParseConfig(dnsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c := DefaultConfig()
+	c.DBPath = dbPath
+	c.DNSProvider = dnsProvider
+	c.DNSConfig = dns
+	c.Host = host
+	c.CADirURL = caDirURL
+	c.HTTPAddr = httpAddr
+	c.HTTPSAddr = httpsAddr
+	c.Timeout = Duration(timeout)
+
+	return NewWithConfig(c)
+}
+
+// NewWithConfig creates the server from the config, the config is validated first
+func NewWithConfig(c Config) (*Context, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := newContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.SetAdminKey(c.AdminKey)
+	ctx.SetTCPLimit(c.MaxTCPPorts, c.MaxTCPPortsPerKey)
+	ctx.SetReservationTTL(time.Duration(c.ReservationTTL))
+
+	err = ctx.SetDDNS(c.IP, c.IPv6, time.Duration(c.DDNSInterval))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Challenge != cert.DNS01 {
+		err = ctx.SetChallenge(c.Challenge, c.CertSubdomains...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Cluster.Name != "" {
+		var coordinator cluster.Coordinator = cluster.NewMemory()
+		if c.Cluster.Coordinator != "" {
+			coordinator = cluster.NewClient(c.Cluster.Coordinator, c.Host, c.Cluster.Secret)
+		}
+		ctx.SetCluster(cluster.Node{Name: c.Cluster.Name, URL: c.Cluster.URL}, c.Cluster.Secret, coordinator)
+	}
+
+	switch c.AccessLog.Path {
+	case "":
+	case "-":
+		ctx.SetAccessLog(os.Stdout)
+	default:
+		ctx.SetAccessLog(&lumberjack.Logger{
+			Filename:   c.AccessLog.Path,
+			MaxSize:    c.AccessLog.MaxSize,
+			MaxBackups: c.AccessLog.MaxBackups,
+			MaxAge:     c.AccessLog.MaxAge,
+			Compress:   true,
+		})
+	}
+
+	return ctx, nil
+}
+
+func newContext(c Config) (*Context, error) {
+	store := storer.New(c.DBPath)
 	certCache := store.Value("cert-cache", &[]byte{})
+	accountCache := store.Value("acme-account", &[]byte{})
 
-	err := setupDNS(dnsProvider, dnsConfig, host)
+	cert, err := setupCert(c.Host, c.DNSProvider, c.DNSConfig, c.CADirURL, c.ACME, certCache, accountCache)
 	if err != nil {
 		return nil, err
 	}
 
-	cert, err := setupCert(host, dnsProvider, dnsConfig, caDirURL, certCache)
+	httpListener, err := net.Listen("tcp", c.HTTPAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	httpListener, err := net.Listen("tcp", httpAddr)
+	httpsListener, err := net.Listen("tcp", c.HTTPSAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	httpsListener, err := net.Listen("tcp", httpsAddr)
+	tcpHost, _, err := net.SplitHostPort(httpListener.Addr().String())
 	if err != nil {
 		return nil, err
 	}
 
 	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
 
 	reqCount := 0
+	timeout := time.Duration(c.Timeout)
 
-	return &Context{
-		host:          host,
+	ctx := &Context{
+		host:          c.Host,
 		cert:          cert,
-		engine:        gin.New(),
-		httpListener:  httpListener,
-		httpsListener: httpsListener,
+		ddns:          setupDNS(c.DNSProvider, c.DNSConfig, c.Host),
+		ddnsInterval:  time.Duration(c.DDNSInterval),
+		caDirURL:      c.CADirURL,
+		certCache:     certCache,
+		caCache:       store.Value("ca-cache", &[]byte{}),
+		accountCache:  accountCache,
+		engine:        engine,
+		httpListener:  &onceListener{Listener: httpListener},
+		httpsListener: &onceListener{Listener: httpsListener},
 		timeout:       timeout,
-		proxy:         newProxy(host),
+		proxy:         newProxy(c.Host, tcpHost, timeout, store, engine),
 		store:         store,
 		reqCounter:    store.Value("reqCount", &reqCount),
+		account:       c.ACME,
+		done:          make(chan struct{}),
 		onError: func(err error) {
 			log.Println(err)
 		},
-	}, nil
+	}
+	ctx.srv, ctx.tlsSrv = ctx.newServers()
+	ctx.proxy.domains.added = ctx.updateDomainCert
+	ctx.proxy.domains.removed = ctx.removeDomainCert
+
+	return ctx, nil
+}
+
+func (ctx *Context) newServers() (*http.Server, *http.Server) {
+	srv := &http.Server{
+		Handler:           ctx.engine,
+		IdleTimeout:       ctx.timeout,
+		ReadHeaderTimeout: ctx.timeout,
+		ReadTimeout:       ctx.timeout,
+		WriteTimeout:      ctx.timeout,
+	}
+
+	tlsSrv := &http.Server{
+		Handler:           srv.Handler,
+		IdleTimeout:       srv.IdleTimeout,
+		ReadHeaderTimeout: srv.ReadHeaderTimeout,
+		ReadTimeout:       srv.ReadTimeout,
+		WriteTimeout:      srv.WriteTimeout,
+		TLSConfig: &tls.Config{
+			NextProtos: []string{"h2", "http/1.1", tlsalpn01.ACMETLS1Protocol},
+			GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if c := ctx.cert.TLSALPNCert(info); c != nil {
+					return c, nil
+				}
+				if c := ctx.getDomainCert(info); c != nil {
+					return c, nil
+				}
+				if c := ctx.cert.Cert(); c != nil {
+					return c, nil
+				}
+				return nil, ErrNoCert
+			},
+		},
+	}
+
+	return srv, tlsSrv
 }
 
 // GetServer ...
@@ -82,19 +244,143 @@ func (ctx *Context) GetServer() *kit.ServerContext {
 	}
 }
 
+// SetAdminKey enables the api key authentication, the admin key is used to manage the api keys.
+// It should be called before Serve.
+func (ctx *Context) SetAdminKey(key string) {
+	ctx.proxy.keys.adminKey = key
+}
+
+// SetTCPLimit caps the public ports allocated by the raw tcp tunnels, maxPorts for the server and
+// maxPortsPerKey for each api key, 0 means no limit. A port is released when no consumer waits on it
+// for the timeout. It should be called before Serve.
+func (ctx *Context) SetTCPLimit(maxPorts, maxPortsPerKey int) {
+	ctx.proxy.tcp.maxPorts = maxPorts
+	ctx.proxy.tcp.maxPortsPerKey = maxPortsPerKey
+}
+
+// SetReservationTTL releases the reserved subdomains that are not used with their tokens for the ttl,
+// 0 means they never expire. It should be called before Serve.
+func (ctx *Context) SetReservationTTL(ttl time.Duration) {
+	ctx.proxy.reservations.ttl = ttl
+}
+
+// SetAccessLog writes the access log of the public requests and the api requests to w as json lines.
+// It should be called before Serve.
+func (ctx *Context) SetAccessLog(w io.Writer) {
+	ctx.proxy.accessLog = newAccessLog(w)
+}
+
+// SetChallenge obtains the certificate via the cert.HTTP01 or cert.TLSALPN01 challenge instead of the dns provider,
+// they can't obtain the wildcard certificate, so only the host and the subdomains will be included.
+// Use cert.LocalCA to issue the wildcard certificate with a local CA, the CA can be downloaded from "/-/ca".
+// It should be called before Serve.
+func (ctx *Context) SetChallenge(challenge string, subdomains ...string) error {
+	c, err := cert.New(cert.Options{
+		Host:         ctx.host,
+		Challenge:    challenge,
+		Subdomains:   subdomains,
+		CADirURL:     ctx.caDirURL,
+		Cache:        &cache{ctx.certCache},
+		CACache:      &cache{ctx.caCache},
+		AccountCache: &cache{ctx.accountCache},
+		Account:      ctx.account,
+	})
+	if err != nil {
+		return err
+	}
+	ctx.cert = c
+	return nil
+}
+
+// SetACME sets the acme account, such as the contact email, the key type and the External Account Binding.
+// It should be called before Serve.
+func (ctx *Context) SetACME(account cert.Account) error {
+	err := account.Validate()
+	if err != nil {
+		return err
+	}
+
+	ctx.account = account
+	if ctx.cert == nil {
+		return nil
+	}
+
+	opts := ctx.cert.Options()
+	opts.Account = account
+	c, err := cert.New(opts)
+	if err != nil {
+		return err
+	}
+	ctx.cert = c
+	return nil
+}
+
+// SetCluster lets the servers behind a load balancer share the consumers, a public request goes to the node
+// that has a waiting consumer of the subdomain, a response goes to the node that holds the public request.
+// All the nodes must share the same coordinator and secret, such as the cluster.Memory of one node and
+// the cluster.Client of the others. The node of the cluster.Memory is the owner, the api keys and
+// the reservations of the other nodes are checked and managed by it. It should be called before Serve.
+func (ctx *Context) SetCluster(node cluster.Node, secret string, coordinator cluster.Coordinator) {
+	m, owner := coordinator.(*cluster.Memory)
+	if owner {
+		m.SetOwner(node, ctx.proxy.localAuth, ctx.timeout)
+	} else {
+		coordinator = cluster.NewCache(coordinator, cluster.CacheTTL)
+	}
+	cp := newClusterProxy(node, secret, coordinator)
+	cp.owner = owner
+	ctx.proxy.cluster = cp
+}
+
+// SetDDNS sets the sources of the ipv4 and ipv6 for the A and AAAA records, check ddns.ParseSource for the format,
+// empty ipv4 means the public ip, empty ipv6 means the AAAA records are not managed.
+// The records are updated when the ips change, they are checked every interval, 0 means only set them on start.
+// It only works with the dns providers that digto can manage the records, such as dnspod.
+// It should be called before Serve.
+func (ctx *Context) SetDDNS(ipv4, ipv6 string, interval time.Duration) error {
+	ctx.ddnsInterval = interval
+	if ctx.ddns == nil {
+		return nil
+	}
+
+	for recordType, s := range map[string]string{ddns.A: ipv4, ddns.AAAA: ipv6} {
+		if s == "" {
+			continue
+		}
+		source, err := ddns.ParseSource(s)
+		if err != nil {
+			return err
+		}
+		ctx.ddns.SetSource(recordType, source)
+	}
+	return nil
+}
+
 // Serve ...
 func (ctx *Context) Serve() error {
-	ctx.engine.GET("/", ctx.homePage)
-	ctx.engine.NoRoute(func(g *gin.Context) {
-		err := ctx.count()
+	if ctx.ddns != nil {
+		err := ctx.ddns.Update()
 		if err != nil {
-			kit.Err(err)
+			return err
+		}
+		if ctx.ddnsInterval > 0 {
+			go ctx.ddns.Watch(ctx.ddnsInterval, ctx.done)
 		}
+	}
 
-		ctx.proxy.handler(g)
-	})
+	ctx.engine.Use(ctx.trackHandler, ctx.acmeChallenge)
+	ctx.engine.GET("/", ctx.homePage)
+	ctx.engine.Any("/-/keys", ctx.api(ctx.owned(ctx.proxy.keys.handle)))
+	ctx.engine.Any("/-/keys/:id", ctx.api(ctx.owned(ctx.proxy.keys.handle)))
+	ctx.engine.GET("/-/metrics", ctx.api(ctx.admin(ctx.metrics)))
+	ctx.engine.GET("/"+metricsSubdomain, ctx.api(ctx.admin(ctx.metrics)))
+	ctx.engine.GET("/-/cert", ctx.api(ctx.admin(ctx.certStatus)))
+	ctx.engine.GET("/-/ca", ctx.api(ctx.ca))
+	ctx.engine.Any("/-/cluster/:action", ctx.api(ctx.coordinator))
+	ctx.engine.NoRoute(ctx.handleProxy)
 
 	go ctx.proxy.eventLoop()
+	go ctx.proxy.cluster.beat(ctx.done)
 
 	kit.Log(
 		"[digto] listen on",
@@ -102,32 +388,233 @@ func (ctx *Context) Serve() error {
 		ctx.httpsListener.Addr().String(),
 	)
 
-	srv := &http.Server{
-		Handler:           ctx.engine,
-		IdleTimeout:       ctx.timeout,
-		ReadHeaderTimeout: ctx.timeout,
-		ReadTimeout:       ctx.timeout,
-		WriteTimeout:      ctx.timeout,
+	go func() {
+		err := ctx.srv.Serve(ctx.httpListener)
+		if err != http.ErrServerClosed && !ctx.proxy.draining() {
+			kit.Err("[digto]", err)
+		}
+	}()
+
+	if ctx.cert != nil {
+		go ctx.renewCert()
+	}
+
+	err := ctx.tlsSrv.ServeTLS(ctx.httpsListener, "", "")
+	if err == http.ErrServerClosed || ctx.proxy.draining() {
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully stops the server, Serve returns nil after it's called.
+// The listeners are closed first, the polling consumers are told to stop, the public requests that
+// no consumer has taken yet get 503, the tunnels and the tcp sessions are closed. The in-flight requests
+// are waited until they finish or the c is done, the consumers respond them via the connections they
+// already have. At last the database is closed. It's safe to call it more than once.
+func (ctx *Context) Shutdown(c context.Context) error {
+	ctx.shutdownOnce.Do(func() {
+		ctx.shutdownErr = ctx.shutdown(c)
+	})
+	return ctx.shutdownErr
+}
+
+func (ctx *Context) shutdown(c context.Context) error {
+	close(ctx.proxy.closing)
+	close(ctx.done)
+
+	for _, l := range []net.Listener{ctx.httpListener, ctx.httpsListener} {
+		_ = l.Close()
+	}
+	ctx.proxy.tcp.close()
+
+	err := ctx.proxy.wait(c)
+
+	// force close the connections if they are still active after the c is done
+	for _, srv := range []*http.Server{ctx.srv, ctx.tlsSrv} {
+		srvErr := srv.Shutdown(c)
+		if srvErr != nil {
+			_ = srv.Close()
+		}
+		if err == nil {
+			err = srvErr
+		}
+	}
+	ctx.proxy.mux.close()
+
+	// the handlers may still use the eventLoop and the database
+	if !waitGroup(&ctx.handlers, handlersTimeout) {
+		if err == nil {
+			return ErrHandlersRunning
+		}
+		return fmt.Errorf("%w: %s", err, ErrHandlersRunning)
+	}
+
+	close(ctx.proxy.stop)
+
+	flushErr := ctx.proxy.keys.flush()
+	if err == nil {
+		err = flushErr
 	}
 
+	closeErr := ctx.store.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// handlersTimeout is how long to wait for the handlers to return after their connections are closed
+const handlersTimeout = 5 * time.Second
+
+func (ctx *Context) trackHandler(g kit.GinContext) {
+	ctx.handlers.Add(1)
+	defer ctx.handlers.Done()
+	g.Next()
+}
+
+// waitGroup returns false if the wg isn't done within the timeout
+func waitGroup(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
 	go func() {
-		kit.Err("[digto]", srv.Serve(ctx.httpListener))
+		wg.Wait()
+		close(done)
 	}()
 
-	tlsSrv := &http.Server{
-		Handler:           srv.Handler,
-		IdleTimeout:       srv.IdleTimeout,
-		ReadHeaderTimeout: srv.ReadHeaderTimeout,
-		ReadTimeout:       srv.ReadTimeout,
-		WriteTimeout:      srv.WriteTimeout,
-		TLSConfig: &tls.Config{
-			GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-				return ctx.cert.Cert(), nil
-			},
-		},
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// onceListener can be closed by both the Shutdown and the http server
+type onceListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (l *onceListener) Close() error {
+	l.once.Do(func() {
+		l.err = l.Listener.Close()
+	})
+	return l.err
+}
+
+// ca responds the pem of the local CA
+func (ctx *Context) ca(g kit.GinContext) {
+	pem := ctx.cert.CA()
+	if pem == nil {
+		apiError(g, "the local CA is not enabled")
+		return
+	}
+	g.Data(http.StatusOK, "application/x-pem-file", pem)
+}
+
+// coordinator serves the coordinator of the cluster to the other nodes
+func (ctx *Context) coordinator(g kit.GinContext) {
+	cp := ctx.proxy.cluster
+	if !cp.enabled() {
+		apiError(g, "the cluster is not enabled")
+		return
+	}
+	cluster.Handler(cp.coordinator, cp.secret).ServeHTTP(g.Writer, g.Request)
+}
+
+// certStatus responds the expiry and the renewal state of the certificate
+func (ctx *Context) certStatus(g kit.GinContext) {
+	if ctx.cert == nil {
+		apiError(g, "the certificate is not enabled")
+		return
+	}
+	g.JSON(http.StatusOK, ctx.cert.Status())
+}
+
+// renewCert obtains the certificate if there's none, then renews it before it expires,
+// failed attempts are retried with exponential backoff
+func (ctx *Context) renewCert() {
+	for {
+		err := ctx.cert.Update()
+		if err != nil {
+			kit.Err("[digto] failed to update the certificate, retry in", ctx.cert.NextAttempt(), err)
+		}
+
+		select {
+		case <-time.After(ctx.cert.NextAttempt()):
+		case <-ctx.done:
+			return
+		}
+	}
+}
+
+// acmeChallenge responds the http-01 challenge requests of any host, including the custom domains
+func (ctx *Context) acmeChallenge(g kit.GinContext) {
+	if ctx.cert.HTTPChallenge(g.Writer, g.Request) {
+		g.Abort()
+		return
+	}
+
+	ctx.domainLock.Lock()
+	c := ctx.domainCerts[g.Request.Host]
+	ctx.domainLock.Unlock()
+
+	if c.HTTPChallenge(g.Writer, g.Request) {
+		g.Abort()
 	}
+}
 
-	return tlsSrv.ServeTLS(ctx.httpsListener, "", "")
+func (ctx *Context) handleProxy(g kit.GinContext) {
+	err := ctx.count()
+	if err != nil {
+		kit.Err(err)
+	}
+
+	ctx.proxy.handler(g)
+}
+
+// api only serves the handler on the api host, requests to other hosts go to the proxy
+func (ctx *Context) api(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(g kit.GinContext) {
+		if g.Request.Host != ctx.host {
+			ctx.handleProxy(g)
+			return
+		}
+		handler(g)
+	}
+}
+
+// admin requires the admin key for the handler if the api key authentication is enabled
+func (ctx *Context) admin(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(g kit.GinContext) {
+		if ctx.proxy.keys.adminKey != "" && !ctx.proxy.keys.admin(g) {
+			apiError(g, "invalid Digto-Admin-Key")
+			return
+		}
+		handler(g)
+	}
+}
+
+// owned forwards the request to the owner node of the cluster, so that the nodes share its state
+func (ctx *Context) owned(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(g kit.GinContext) {
+		if ctx.proxy.cluster.toOwner(g) {
+			return
+		}
+		handler(g)
+	}
+}
+
+func (ctx *Context) metrics(g kit.GinContext) {
+	if ctx.cert != nil {
+		status := ctx.cert.Status()
+		if !status.NotAfter.IsZero() {
+			ctx.proxy.metrics.set("digto_cert_expiry_timestamp_seconds", series{"": float64(status.NotAfter.Unix())})
+		}
+		ctx.proxy.metrics.set("digto_cert_renewal_failures", series{"": float64(status.Failures)})
+	}
+
+	ctx.proxy.metrics.handle(g)
 }
 
 func (ctx *Context) count() error {
@@ -174,6 +661,10 @@ func (ctx *Context) homePage(ginCtx kit.GinContext) {
 
 {{.proxyStatus}}
 
+## Inspector
+
+Open /{subdomain}/inspect on this host to view the recent requests of the subdomain.
+
 ## API
 
 https://github.com/ysmood/digto	
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ysmood/digto/internal/netutil"
+	"github.com/ysmood/kit"
+)
+
+// ErrTCPPorts ...
+var ErrTCPPorts = errors.New("no tcp port is available on the server")
+
+// ErrTCPPortQuota ...
+var ErrTCPPortQuota = errors.New("tcp port quota of the key is exceeded")
+
+// tcpProxy allocates a public port for each subdomain and streams the raw tcp connections to the consumers
+type tcpProxy struct {
+	host    string
+	timeout time.Duration
+	closing chan struct{}
+
+	// maxPorts caps the allocated ports of the server, maxPortsPerKey caps them for each api key,
+	// 0 means no limit
+	maxPorts       int
+	maxPortsPerKey int
+
+	lock    sync.Mutex
+	tunnels map[string]*tcpTunnel
+}
+
+type tcpTunnel struct {
+	listener  net.Listener
+	conns     chan net.Conn
+	consumers int
+
+	// key is the id of the api key that allocates the port, empty if the authentication is disabled
+	key string
+}
+
+func newTCPProxy(host string, timeout time.Duration, closing chan struct{}) *tcpProxy {
+	return &tcpProxy{
+		host:    host,
+		timeout: timeout,
+		closing: closing,
+		tunnels: map[string]*tcpTunnel{},
+	}
+}
+
+// handle responds the allocated port with the Digto-Port header,
+// if the request is an upgrade request it will wait for the next public connection and splice them.
+func (tp *tcpProxy) handle(subdomain, key string, ctx kit.GinContext) {
+	t, err := tp.get(subdomain, key)
+	if err != nil {
+		apiError(ctx, err.Error())
+		return
+	}
+
+	ctx.Header("Digto-Port", strconv.Itoa(t.listener.Addr().(*net.TCPAddr).Port))
+
+	if !netutil.IsUpgrade(ctx.Request) {
+		return
+	}
+
+	tp.join(t)
+	defer tp.leave(subdomain, t)
+
+	select {
+	case conn := <-t.conns:
+		consumer, err := hijack(ctx)
+		if err != nil {
+			_ = conn.Close()
+			apiError(ctx, err.Error())
+			return
+		}
+
+		err = switchProtocols(consumer, http.Header{
+			"Connection":        {"Upgrade"},
+			"Upgrade":           {"digto"},
+			"Digto-Remote-Addr": {conn.RemoteAddr().String()},
+		})
+		if err != nil {
+			_ = conn.Close()
+			_ = consumer.Close()
+			return
+		}
+
+		splice(tp.closing, conn, consumer)
+
+	case <-tp.closing:
+		apiError(ctx, ErrShuttingDown.Error())
+
+	case <-ctx.Request.Context().Done():
+	}
+}
+
+// get the tunnel of the subdomain, create one if not exists and the limits allow
+func (tp *tcpProxy) get(subdomain, key string) (*tcpTunnel, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	if t, has := tp.tunnels[subdomain]; has {
+		return t, nil
+	}
+
+	select {
+	case <-tp.closing:
+		return nil, ErrShuttingDown
+	default:
+	}
+
+	if tp.maxPorts > 0 && len(tp.tunnels) >= tp.maxPorts {
+		return nil, ErrTCPPorts
+	}
+
+	if key != "" && tp.maxPortsPerKey > 0 {
+		count := 0
+		for _, t := range tp.tunnels {
+			if t.key == key {
+				count++
+			}
+		}
+		if count >= tp.maxPortsPerKey {
+			return nil, ErrTCPPortQuota
+		}
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(tp.host, "0"))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tcpTunnel{
+		listener: l,
+		conns:    make(chan net.Conn),
+		key:      key,
+	}
+	tp.tunnels[subdomain] = t
+
+	go tp.accept(t)
+	tp.expire(subdomain, t)
+
+	return t, nil
+}
+
+func (tp *tcpProxy) accept(t *tcpTunnel) {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			select {
+			case t.conns <- conn:
+			case <-time.After(tp.timeout):
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+func (tp *tcpProxy) join(t *tcpTunnel) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	t.consumers++
+}
+
+func (tp *tcpProxy) leave(subdomain string, t *tcpTunnel) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	t.consumers--
+	tp.expire(subdomain, t)
+}
+
+// close the listeners of all the tunnels
+func (tp *tcpProxy) close() {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	for subdomain, t := range tp.tunnels {
+		_ = t.listener.Close()
+		delete(tp.tunnels, subdomain)
+	}
+}
+
+// expire closes the listener if no consumer joins the tunnel within the timeout
+func (tp *tcpProxy) expire(subdomain string, t *tcpTunnel) {
+	if t.consumers > 0 {
+		return
+	}
+
+	time.AfterFunc(tp.timeout, func() {
+		tp.lock.Lock()
+		defer tp.lock.Unlock()
+
+		if t.consumers > 0 || tp.tunnels[subdomain] != t {
+			return
+		}
+
+		_ = t.listener.Close()
+		delete(tp.tunnels, subdomain)
+	})
+}
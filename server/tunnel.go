@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ysmood/digto/internal/netutil"
+	"github.com/ysmood/kit"
+)
+
+// tunnel hijacks both the public connection and the consumer connection,
+// then splices them into a bidirectional byte stream.
+// The headers of the consumer request will be used as the 101 response headers for the public.
+// The error is only returned when no connection is hijacked yet, so that the caller can still report it.
+// The connections are closed when the closing is closed.
+func tunnel(public, consumer kit.GinContext, closing <-chan struct{}) error {
+	pubConn, err := hijack(public)
+	if err != nil {
+		return err
+	}
+
+	conConn, err := hijack(consumer)
+	if err != nil {
+		_, _ = io.WriteString(pubConn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+		_ = pubConn.Close()
+		return nil
+	}
+
+	header := http.Header{}
+	for k, l := range consumer.Request.Header {
+		if strings.HasPrefix(k, "Digto") || k == "Content-Length" {
+			continue
+		}
+		header[k] = l
+	}
+
+	err = switchProtocols(pubConn, header)
+	if err == nil {
+		err = switchProtocols(conConn, http.Header{
+			"Connection": {"Upgrade"},
+			"Upgrade":    {"digto"},
+		})
+	}
+	if err != nil {
+		_ = pubConn.Close()
+		_ = conConn.Close()
+		return nil
+	}
+
+	splice(closing, pubConn, conConn)
+
+	return nil
+}
+
+// splice the connections until either side is done or the closing is closed
+func splice(closing <-chan struct{}, a, b net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-closing:
+			_ = a.Close()
+			_ = b.Close()
+		case <-done:
+		}
+	}()
+
+	netutil.Splice(a, b)
+}
+
+func switchProtocols(conn net.Conn, header http.Header) error {
+	_, err := fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\n")
+	if err != nil {
+		return err
+	}
+	err = header.Write(conn)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(conn, "\r\n")
+	return err
+}
+
+// hijack takes over the connection of the request, the deadlines set by the http server will be cleared
+func hijack(ctx kit.GinContext) (net.Conn, error) {
+	conn, buf, err := ctx.Writer.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &bufConn{conn, buf.Reader}, nil
+}
+
+// bufConn reads the data already buffered by the http server before the raw connection
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -3,12 +3,10 @@ package server
 import (
 	"encoding/base64"
 	"net/http"
-	"time"
 
-	"github.com/ysmood/ddns/adapters"
 	"github.com/ysmood/digto/server/cert"
+	"github.com/ysmood/digto/server/ddns"
 	"github.com/ysmood/kit"
-	"github.com/ysmood/myip"
 	"github.com/ysmood/storer"
 )
 
@@ -28,63 +26,76 @@ func (c *cache) Set(data []byte) error {
 	return c.store.Set(&data)
 }
 
-func setupDNS(dnsProvider, dnsConfig, host string) error {
-	if dnsProvider == "" || dnsConfig == "" {
+// setupDNS returns nil if the records of the provider are not managed
+func setupDNS(dnsProvider string, dnsConfig map[string]string, host string) *ddns.Watcher {
+	if dnsProvider == "" || len(dnsConfig) == 0 {
 		return nil
 	}
 
-	ip, err := myip.GetPublicIP()
-	if err != nil {
-		return err
-	}
-	dnsClient := adapters.New(dnsProvider, dnsConfig)
-	err = dnsClient.SetRecord("*", host, ip)
-	if err != nil {
-		return err
-	}
-	err = dnsClient.SetRecord("@", host, ip)
-	if err != nil {
-		return err
+	records := ddns.NewRecords(dnsProvider, dnsConfig)
+	if records == nil {
+		kit.Log("[digto] dns records are not managed for the provider", dnsProvider,
+			"point the @ and * records of", host, "to this server manually")
+		return nil
 	}
-	return nil
+	return ddns.New(host, records)
 }
 
-func setupCert(host, dnsProvider, dnsConfig, caDirURL string, certCache *storer.Value) (*cert.Context, error) {
-	if dnsConfig == "" {
+func setupCert(
+	host, dnsProvider string, dnsConfig map[string]string, caDirURL string,
+	account cert.Account, certCache, accountCache *storer.Value,
+) (*cert.Context, error) {
+	if len(dnsConfig) == 0 {
 		return nil, nil
 	}
 
-	cert, err := cert.New(
-		host,
-		dnsProvider,
-		dnsConfig,
-		caDirURL,
-		&cache{certCache},
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	go func() {
-		for {
-			time.Sleep(24 * time.Hour)
-			err := cert.Update()
-			if err != nil {
-				kit.Err("[digto]", err)
-			}
-		}
-	}()
-
-	return cert, nil
-
+	return cert.New(cert.Options{
+		Host:         host,
+		Provider:     dnsProvider,
+		Config:       dnsConfig,
+		CADirURL:     caDirURL,
+		Cache:        &cache{certCache},
+		AccountCache: &cache{accountCache},
+		Account:      account,
+	})
 }
 
 func apiError(ginCtx kit.GinContext, msg string) {
+	apiErrorStatus(ginCtx, http.StatusBadRequest, msg)
+}
+
+func apiErrorStatus(ginCtx kit.GinContext, status int, msg string) {
 	ginCtx.Writer.Header().Set("Digto-Error", msg)
-	ginCtx.AbortWithStatus(http.StatusBadRequest)
+	ginCtx.AbortWithStatus(status)
 	_, _ = ginCtx.Writer.WriteString(msg)
 }
 
+// authError responds 401 for the invalid key and 403 for the invalid token, so that the clients can stop retrying.
+// The errors from the owner node of the cluster are compared by the messages.
+func authError(ginCtx kit.GinContext, err error) {
+	switch err.Error() {
+	case ErrInvalidKey.Error():
+		apiErrorStatus(ginCtx, http.StatusUnauthorized, err.Error())
+	case ErrInvalidToken.Error():
+		apiErrorStatus(ginCtx, http.StatusForbidden, err.Error())
+	default:
+		apiError(ginCtx, err.Error())
+	}
+}
+
 func randString() string {
 	return base64.RawURLEncoding.EncodeToString(kit.RandBytes(8))
 }
+
+// flushWriter flushes each write, so that the streaming responses reach the public without delay
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (w flushWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}